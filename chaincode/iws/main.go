@@ -0,0 +1,22 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command iws runs the IWS design of the Consentio chaincode, package iws. This
+// directory is the path given to peer chaincode install; its META-INF holds the CouchDB
+// indexes packaged with the chaincode.
+package main
+
+import (
+	"fmt"
+
+	"github.com/ddhruvkr/Consentio/iws"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func main() {
+	err := shim.Start(new(iws.SimpleChaincode))
+	if err != nil {
+		fmt.Printf("Error starting Simple chaincode: %s", err)
+	}
+}
@@ -0,0 +1,22 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command rws runs the RWS design of the Consentio chaincode, package rws. This
+// directory is the path given to peer chaincode install; its META-INF holds the CouchDB
+// indexes packaged with the chaincode.
+package main
+
+import (
+	"fmt"
+
+	"github.com/ddhruvkr/Consentio/rws"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func main() {
+	err := shim.Start(new(rws.SimpleChaincode))
+	if err != nil {
+		fmt.Printf("Error starting Simple chaincode: %s", err)
+	}
+}
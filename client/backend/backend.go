@@ -0,0 +1,64 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package backend opens the client Backend the commands are configured with by flags.
+// Programs are built with the gateway backend, or with the memory backend when built
+// with the memory tag (go build -tags memory): the chaincode runs on Fabric 1.4, which
+// registers protobuf types under the same names as the SDK, so no program can link both.
+package backend
+
+import (
+	"flag"
+	"os"
+	"strings"
+)
+
+// Config holds the flags of both backends.
+type Config struct {
+	Backend string // gateway or memory
+
+	// gateway
+	ConnectionProfile string
+	WalletPath        string
+	Identity          string // wallet label, or for memory admin, custodian, watchdog, consumer or patient:<id>
+	Channel           string
+	Chaincode         string
+
+	// memory
+	Design        string // iws or rws
+	StateFile     string
+	Watchdogs     string // comma-separated, registered on a new ledger
+	WatchdogRoles string // comma-separated roles they govern
+}
+
+// Register defines the flags, which default to the CONSENTIO_* environment variables.
+func (c *Config) Register(flags *flag.FlagSet) {
+	flags.StringVar(&c.Backend, "backend", env("CONSENTIO_BACKEND", defaultBackend), "backend, gateway or memory (built with -tags memory)")
+	flags.StringVar(&c.ConnectionProfile, "profile", os.Getenv("CONSENTIO_PROFILE"), "connection profile")
+	flags.StringVar(&c.WalletPath, "wallet", env("CONSENTIO_WALLET", "wallet"), "wallet directory")
+	flags.StringVar(&c.Identity, "identity", os.Getenv("CONSENTIO_IDENTITY"), "identity label in the wallet, or local identity of the memory backend")
+	flags.StringVar(&c.Channel, "channel", env("CONSENTIO_CHANNEL", "mychannel"), "channel name")
+	flags.StringVar(&c.Chaincode, "chaincode", env("CONSENTIO_CHAINCODE", "consentio"), "chaincode name")
+	flags.StringVar(&c.Design, "design", env("CONSENTIO_DESIGN", "iws"), "chaincode design of the memory backend, iws or rws")
+	flags.StringVar(&c.StateFile, "state", env("CONSENTIO_STATE", "consentio-state.json"), "ledger file of the memory backend, empty to keep it in memory")
+	flags.StringVar(&c.Watchdogs, "watchdogs", "hippa", "watchdogs registered on a new memory ledger")
+	flags.StringVar(&c.WatchdogRoles, "watchdog-roles", "all", "roles the watchdogs of a new memory ledger govern")
+}
+
+func env(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func list(ids string) []string {
+	var list []string
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			list = append(list, id)
+		}
+	}
+	return list
+}
@@ -0,0 +1,32 @@
+//go:build !memory
+
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package backend
+
+import (
+	"fmt"
+
+	"github.com/ddhruvkr/Consentio/client"
+	"github.com/ddhruvkr/Consentio/client/gateway"
+)
+
+const defaultBackend = "gateway"
+
+// Open connects to the network. The returned function closes the connection.
+func Open(c *Config) (client.Backend, func(), error) {
+	if c.Backend != "gateway" {
+		return nil, nil, fmt.Errorf("backend %s is not built in, the memory backend needs go build -tags memory", c.Backend)
+	}
+	if c.ConnectionProfile == "" || c.Identity == "" {
+		return nil, nil, fmt.Errorf("-profile and -identity are required")
+	}
+	gw, err := gateway.New(gateway.Config{ConnectionProfile: c.ConnectionProfile, WalletPath: c.WalletPath,
+		Identity: c.Identity, Channel: c.Channel, Chaincode: c.Chaincode})
+	if err != nil {
+		return nil, nil, err
+	}
+	return gw, gw.Close, nil
+}
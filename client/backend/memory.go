@@ -0,0 +1,33 @@
+//go:build memory
+
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package backend
+
+import (
+	"fmt"
+
+	"github.com/ddhruvkr/Consentio/client"
+	"github.com/ddhruvkr/Consentio/client/memory"
+)
+
+const defaultBackend = "memory"
+
+// Open loads the ledger, or starts a new one. The identity defaults to custodian.
+func Open(c *Config) (client.Backend, func(), error) {
+	if c.Backend != "memory" {
+		return nil, nil, fmt.Errorf("backend %s is not built in, programs built with -tags memory only have the memory backend", c.Backend)
+	}
+	identity := c.Identity
+	if identity == "" {
+		identity = "custodian"
+	}
+	m, err := memory.New(memory.Config{Design: c.Design, StateFile: c.StateFile, Identity: identity,
+		Watchdogs: list(c.Watchdogs), WatchdogRoles: list(c.WatchdogRoles)})
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, m.Close, nil
+}
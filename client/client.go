@@ -0,0 +1,363 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package client calls the Consentio chaincode functions with named JSON arguments. It
+// works with either design: the same functions and argument names are used by both.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Backend runs chaincode functions. Submit goes through ordering and commits, Evaluate
+// only queries a peer.
+type Backend interface {
+	Submit(function string, args map[string]interface{}) ([]byte, error)
+	Evaluate(function string, args map[string]interface{}) ([]byte, error)
+}
+
+// Error is a failure reported by the chaincode.
+type Error struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// ParseError returns the chaincode error carried in the message of err as an *Error, or
+// err itself when it has none. Backends call it on the errors of their SDK.
+func ParseError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	for i := 0; i < len(message); i++ {
+		if message[i] != '{' {
+			continue
+		}
+		cerr := &Error{}
+		if json.NewDecoder(strings.NewReader(message[i:])).Decode(cerr) == nil && cerr.Code != "" {
+			return cerr
+		}
+	}
+	return err
+}
+
+// Consent names a patient's consent setting: the role, the window and the watchdog. IWS
+// keeps the setting per column, so History needs ColumnIDs there; RWS only uses them to
+// filter the history.
+type Consent struct {
+	PatientID  string   `json:"patient_id"`
+	RoleID     string   `json:"role_id"`
+	StartDate  string   `json:"start_date"`
+	EndDate    string   `json:"end_date,omitempty"`
+	ColumnIDs  []string `json:"column_ids,omitempty"`
+	WatchdogID string   `json:"watchdog_id"`
+}
+
+// AccessRequest is a data consumer's request to read columns under a role and window.
+// ConsumerID must be left empty for RWS; IWS takes the consumer from the caller's
+// certificate and only checks it against ConsumerID when it is given.
+type AccessRequest struct {
+	RoleID     string   `json:"role_id"`
+	StartDate  string   `json:"start_date"`
+	EndDate    string   `json:"end_date"`
+	ColumnIDs  []string `json:"column_ids"`
+	WatchdogID string   `json:"watchdog_id"`
+	ConsumerID string   `json:"consumer_id,omitempty"`
+}
+
+// Step is one step of an access decision.
+type Step struct {
+	Step   string `json:"step"`
+	Passed bool   `json:"passed"`
+	Code   string `json:"code,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// Decision is the outcome of an access check with every step that led to it.
+type Decision struct {
+	RoleID      string              `json:"r_id"`
+	StartDate   string              `json:"s_date"`
+	EndDate     string              `json:"e_date"`
+	WatchdogID  string              `json:"w_id"`
+	ConsumerID  string              `json:"dc_id,omitempty"`
+	Steps       []Step              `json:"steps"`
+	Columns     map[string]int      `json:"columns"`
+	Patients    map[string][]string `json:"patients,omitempty"`    // consenting patients per column when granted, hashed when the channel hashes patient ids
+	Certificate json.RawMessage     `json:"certificate,omitempty"` // issued by RequestAccess only
+	Granted     bool                `json:"granted"`
+	Code        string              `json:"code,omitempty"`
+	Reason      string              `json:"reason,omitempty"`
+}
+
+// HistoryEntry is the set of columns consented to after one transaction.
+type HistoryEntry struct {
+	TxID      string   `json:"tx_id"`
+	Timestamp string   `json:"timestamp"`
+	ColumnIDs []string `json:"column_ids"`
+}
+
+// Client wraps a Backend with one method per consent operation.
+type Client struct {
+	Backend Backend
+}
+
+// New returns a client using backend.
+func New(backend Backend) *Client {
+	return &Client{Backend: backend}
+}
+
+// args drops the empty values, which the chaincode would reject for functions that do
+// not take them.
+func args(a map[string]interface{}) map[string]interface{} {
+	for name, value := range a {
+		switch v := value.(type) {
+		case string:
+			if v == "" {
+				delete(a, name)
+			}
+		case []string:
+			if len(v) == 0 {
+				delete(a, name)
+			}
+		}
+	}
+	return a
+}
+
+func (c *Client) updateConsent(consent Consent, action string, sig Signature) ([]byte, error) {
+	return c.Backend.Submit("updateConsent", args(map[string]interface{}{
+		"patient_id": consent.PatientID, "action": action, "role_id": consent.RoleID,
+		"start_date": consent.StartDate, "end_date": consent.EndDate,
+		"column_ids": consent.ColumnIDs, "watchdog_id": consent.WatchdogID,
+		"signature": sig.Value, "nonce": sig.Nonce,
+	}))
+}
+
+// Signature is a patient's signature of a consent operation, made over SigningMessage
+// with the key registered by RegisterPatientKey. Value is base64 encoded: ASN.1 DER over
+// the SHA-256 of the message for ECDSA, over the message itself for Ed25519.
+type Signature struct {
+	Nonce string
+	Value string
+}
+
+// SigningMessage returns the message a patient signs to grant (action "g") or revoke
+// ("r") consent. The nonce must not have been used by the patient before.
+func SigningMessage(consent Consent, action, nonce string) ([]byte, error) {
+	columnIDs := consent.ColumnIDs
+	if columnIDs == nil {
+		columnIDs = []string{}
+	}
+	// same fields, order and normalisation as the chaincode
+	return json.Marshal(struct {
+		PatientID  string   `json:"patient_id"`
+		Action     string   `json:"action"`
+		RoleID     string   `json:"role_id"`
+		StartDate  string   `json:"start_date"`
+		EndDate    string   `json:"end_date"`
+		ColumnIDs  []string `json:"column_ids"`
+		WatchdogID string   `json:"watchdog_id"`
+		Nonce      string   `json:"nonce"`
+	}{strings.ToLower(consent.PatientID), strings.ToLower(action), strings.ToLower(consent.RoleID),
+		strings.ToLower(consent.StartDate), strings.ToLower(consent.EndDate), columnIDs,
+		strings.ToLower(consent.WatchdogID), nonce})
+}
+
+// UpdateSigned grants (action "g") or revokes ("r") consent with the patient's
+// signature, which is required once the patient has registered a key. A grant returns
+// the consent receipt.
+func (c *Client) UpdateSigned(consent Consent, action string, sig Signature) (json.RawMessage, error) {
+	return c.updateConsent(consent, action, sig)
+}
+
+// RegisterPatientKey registers the PEM encoded ECDSA or Ed25519 public key a patient signs
+// consent operations with. Replacing a key needs the signature, by the current key, of
+// the JSON object {"patient_id":...,"public_key":...}; leave it empty otherwise.
+func (c *Client) RegisterPatientKey(patientID, publicKey, signature string) error {
+	_, err := c.Backend.Submit("registerPatientKey", args(map[string]interface{}{
+		"patient_id": patientID, "public_key": publicKey, "signature": signature,
+	}))
+	return err
+}
+
+// Grant gives the patient's consent on the columns and returns the consent receipt. The
+// receipt has to be kept byte for byte to be checked later with VerifyReceipt. It is nil
+// when the consent was already given, as nothing changed.
+func (c *Client) Grant(consent Consent) (json.RawMessage, error) {
+	receipt, err := c.updateConsent(consent, "g", Signature{})
+	if len(receipt) == 0 {
+		return nil, err
+	}
+	return receipt, err
+}
+
+// Revoke withdraws the patient's consent on the columns.
+func (c *Client) Revoke(consent Consent) error {
+	_, err := c.updateConsent(consent, "r", Signature{})
+	return err
+}
+
+// SetState moves the patient's consent to another lifecycle state: active, suspended,
+// expired or withdrawn. IWS keeps a state per column, so ColumnIDs are required there;
+// RWS keeps one per setting and ColumnIDs must be left empty.
+func (c *Client) SetState(consent Consent, state string) error {
+	_, err := c.Backend.Submit("setConsentState", args(map[string]interface{}{
+		"patient_id": consent.PatientID, "role_id": consent.RoleID,
+		"start_date": consent.StartDate, "end_date": consent.EndDate,
+		"column_ids": consent.ColumnIDs, "watchdog_id": consent.WatchdogID, "state": state,
+	}))
+	return err
+}
+
+// VerifyReceipt tells whether a consent receipt matches the hash recorded when it was issued.
+func (c *Client) VerifyReceipt(receipt json.RawMessage) (bool, error) {
+	payload, err := c.Backend.Evaluate("verifyConsentReceipt", map[string]interface{}{"receipt": string(receipt)})
+	if err != nil {
+		return false, err
+	}
+	var result struct {
+		Match bool `json:"match"`
+	}
+	err = json.Unmarshal(payload, &result)
+	if err != nil {
+		return false, fmt.Errorf("decoding verification: %v", err)
+	}
+	return result.Match, nil
+}
+
+// ApproveRole lets a watchdog grant (or, with grant false, revoke) a data consumer's
+// approval for a role. Only IWS keeps role approvals.
+func (c *Client) ApproveRole(watchdogID, roleID, consumerID string, grant bool) error {
+	action := "r"
+	if grant {
+		action = "g"
+	}
+	_, err := c.Backend.Submit("updateRole", args(map[string]interface{}{
+		"watchdog_id": watchdogID, "role_id": roleID, "consumer_id": consumerID, "action": action,
+	}))
+	return err
+}
+
+// ApproveRoleUntil grants a data consumer's approval for a role up to and including the
+// end date (YYYYMMDD); granting again replaces the end date.
+func (c *Client) ApproveRoleUntil(watchdogID, roleID, consumerID, endDate string) error {
+	_, err := c.Backend.Submit("updateRole", args(map[string]interface{}{
+		"watchdog_id": watchdogID, "role_id": roleID, "consumer_id": consumerID, "action": "g", "end_date": endDate,
+	}))
+	return err
+}
+
+// SweepReport is the outcome of one SweepExpired call.
+type SweepReport struct {
+	Mode     string `json:"mode"`
+	Date     string `json:"date"`
+	Consents int    `json:"consents"`
+	Roles    int    `json:"roles"` // IWS only
+	Cursor   string `json:"cursor,omitempty"`
+	Complete bool   `json:"complete"`
+}
+
+// SweepExpired marks as expired (mode "mark") or deletes (mode "delete") up to limit
+// consents whose end date has passed; IWS also deletes lapsed role approvals. While the
+// report is not complete, call it again with the returned cursor.
+func (c *Client) SweepExpired(mode string, limit int, cursor string) (*SweepReport, error) {
+	payload, err := c.Backend.Submit("sweepExpired", args(map[string]interface{}{
+		"mode": mode, "limit": fmt.Sprint(limit), "cursor": cursor,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	report := &SweepReport{}
+	err = json.Unmarshal(payload, report)
+	if err != nil {
+		return nil, fmt.Errorf("decoding sweep report: %v", err)
+	}
+	return report, nil
+}
+
+// CheckAccess evaluates an access request without failing on a denial; the returned
+// decision says whether access is granted and why.
+func (c *Client) CheckAccess(request AccessRequest) (*Decision, error) {
+	payload, err := c.Backend.Evaluate("explainAccess", args(map[string]interface{}{
+		"role_id": request.RoleID, "start_date": request.StartDate, "end_date": request.EndDate,
+		"column_ids": request.ColumnIDs, "watchdog_id": request.WatchdogID, "consumer_id": request.ConsumerID,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	decision := &Decision{}
+	err = json.Unmarshal(payload, decision)
+	if err != nil {
+		return nil, fmt.Errorf("decoding decision: %v", err)
+	}
+	return decision, nil
+}
+
+// RequestAccess asks for access and, when it is granted, returns the decision with the
+// access certificate the custodian checks with VerifyCertificate before releasing data.
+// A denial is returned as an error.
+func (c *Client) RequestAccess(request AccessRequest) (*Decision, error) {
+	payload, err := c.Backend.Submit("accessConsent", args(map[string]interface{}{
+		"role_id": request.RoleID, "start_date": request.StartDate, "end_date": request.EndDate,
+		"column_ids": request.ColumnIDs, "watchdog_id": request.WatchdogID, "consumer_id": request.ConsumerID,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	decision := &Decision{}
+	err = json.Unmarshal(payload, decision)
+	if err != nil {
+		return nil, fmt.Errorf("decoding decision: %v", err)
+	}
+	return decision, nil
+}
+
+// CertificateCheck is the outcome of checking an access certificate.
+type CertificateCheck struct {
+	Match   bool `json:"match"`   // the certificate was issued as shown
+	Expired bool `json:"expired"` // its window has ended
+	Current bool `json:"current"` // the same patients still consent to the same columns
+}
+
+// VerifyCertificate checks an access certificate shown by the data consumer with client
+// id presenter. A data consumer checking its own certificate leaves presenter empty.
+func (c *Client) VerifyCertificate(certificate json.RawMessage, presenter string) (*CertificateCheck, error) {
+	payload, err := c.Backend.Evaluate("verifyAccessCertificate", args(map[string]interface{}{
+		"certificate": string(certificate), "presenter": presenter,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	check := &CertificateCheck{}
+	err = json.Unmarshal(payload, check)
+	if err != nil {
+		return nil, fmt.Errorf("decoding certificate check: %v", err)
+	}
+	return check, nil
+}
+
+// History returns the changes to a patient's consent setting, oldest first.
+func (c *Client) History(consent Consent) ([]HistoryEntry, error) {
+	payload, err := c.Backend.Evaluate("getConsentHistory", args(map[string]interface{}{
+		"patient_id": consent.PatientID, "role_id": consent.RoleID,
+		"start_date": consent.StartDate, "end_date": consent.EndDate,
+		"column_ids": consent.ColumnIDs, "watchdog_id": consent.WatchdogID,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	var history []HistoryEntry
+	err = json.Unmarshal(payload, &history)
+	if err != nil {
+		return nil, fmt.Errorf("decoding history: %v", err)
+	}
+	return history, nil
+}
@@ -0,0 +1,134 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// call is one call a recorder received, with its arguments as the backends encode them.
+type call struct {
+	submit   bool
+	function string
+	args     string
+}
+
+// recorder is a Backend that records its calls and returns a fixed payload.
+type recorder struct {
+	calls   []call
+	payload []byte
+	err     error
+}
+
+func (r *recorder) record(submit bool, function string, args map[string]interface{}) ([]byte, error) {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	r.calls = append(r.calls, call{submit, function, string(argsJSON)})
+	return r.payload, r.err
+}
+
+func (r *recorder) Submit(function string, args map[string]interface{}) ([]byte, error) {
+	return r.record(true, function, args)
+}
+
+func (r *recorder) Evaluate(function string, args map[string]interface{}) ([]byte, error) {
+	return r.record(false, function, args)
+}
+
+func TestGrantDropsEmptyArguments(t *testing.T) {
+	r := &recorder{payload: []byte(`{"consentReceiptID":"tx1"}`)}
+	receipt, err := New(r).Grant(Consent{PatientID: "2", RoleID: "all", StartDate: "20190101",
+		ColumnIDs: []string{"103", "104"}, WatchdogID: "hippa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := call{true, "updateConsent", `{"action":"g","column_ids":["103","104"],"patient_id":"2","role_id":"all","start_date":"20190101","watchdog_id":"hippa"}`}
+	if len(r.calls) != 1 || r.calls[0] != want {
+		t.Errorf("calls = %+v, want %+v", r.calls, want)
+	}
+	if string(receipt) != string(r.payload) {
+		t.Errorf("receipt = %s, want the payload unchanged", receipt)
+	}
+}
+
+func TestSignedRevokeCarriesSignature(t *testing.T) {
+	r := &recorder{}
+	_, err := New(r).UpdateSigned(Consent{PatientID: "2", RoleID: "all", StartDate: "20190101", EndDate: "20190201",
+		ColumnIDs: []string{"103"}, WatchdogID: "hippa"}, "r", Signature{Nonce: "n1", Value: "c2ln"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"action":"r","column_ids":["103"],"end_date":"20190201","nonce":"n1","patient_id":"2","role_id":"all","signature":"c2ln","start_date":"20190101","watchdog_id":"hippa"}`
+	if r.calls[0].args != want {
+		t.Errorf("args = %s, want %s", r.calls[0].args, want)
+	}
+}
+
+func TestAccessFunctions(t *testing.T) {
+	r := &recorder{payload: []byte(`{"granted":true,"columns":{"103":1}}`)}
+	c := New(r)
+	// RWS takes no consumer id, which is then left out
+	request := AccessRequest{RoleID: "all", StartDate: "20190101", EndDate: "20190201", ColumnIDs: []string{"103"}, WatchdogID: "hippa"}
+	decision, err := c.CheckAccess(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Granted || decision.Columns["103"] != 1 {
+		t.Errorf("decision = %+v", decision)
+	}
+	request.ConsumerID = "dc1"
+	_, err = c.RequestAccess(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []call{
+		{false, "explainAccess", `{"column_ids":["103"],"end_date":"20190201","role_id":"all","start_date":"20190101","watchdog_id":"hippa"}`},
+		{true, "accessConsent", `{"column_ids":["103"],"consumer_id":"dc1","end_date":"20190201","role_id":"all","start_date":"20190101","watchdog_id":"hippa"}`},
+	}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("calls = %+v, want %+v", r.calls, want)
+	}
+}
+
+func TestSweepLimitIsText(t *testing.T) {
+	r := &recorder{payload: []byte(`{"mode":"mark","complete":true}`)}
+	_, err := New(r).SweepExpired("mark", 200, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"limit":"200","mode":"mark"}`; r.calls[0].args != want {
+		t.Errorf("args = %s, want %s", r.calls[0].args, want)
+	}
+}
+
+func TestSigningMessage(t *testing.T) {
+	message, err := SigningMessage(Consent{PatientID: "P2", RoleID: "All", StartDate: "20190101",
+		WatchdogID: "HIPPA"}, "G", "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the chaincode's field order, lower-cased ids and an empty column list rather than null
+	want := `{"patient_id":"p2","action":"g","role_id":"all","start_date":"20190101","end_date":"","column_ids":[],"watchdog_id":"hippa","nonce":"n1"}`
+	if string(message) != want {
+		t.Errorf("message = %s, want %s", message, want)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	err := ParseError(errors.New(`endorsement failure: {"code":"NOT_FOUND","message":"Consent not found"}`))
+	cerr, ok := err.(*Error)
+	if !ok || cerr.Code != "NOT_FOUND" || cerr.Message != "Consent not found" {
+		t.Errorf("ParseError = %#v", err)
+	}
+	plain := errors.New("connection refused {")
+	if ParseError(plain) != plain || ParseError(nil) != nil {
+		t.Errorf("errors without a chaincode error must be returned unchanged")
+	}
+}
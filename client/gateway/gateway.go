@@ -0,0 +1,83 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package gateway is the client Backend talking to a Fabric network through the SDK
+// gateway. It cannot be linked into a program with the chaincode packages: Fabric 1.4 and
+// the SDK register protobuf types under the same names.
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/ddhruvkr/Consentio/client"
+	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
+	sdk "github.com/hyperledger/fabric-sdk-go/pkg/gateway"
+)
+
+// Config locates the network and the identity to call it with.
+type Config struct {
+	ConnectionProfile string // connection profile YAML of the organisation
+	WalletPath        string // file system wallet holding Identity
+	Identity          string // label of the identity in the wallet
+	Channel           string
+	Chaincode         string
+}
+
+// Gateway is a Backend talking to a Fabric network through the SDK gateway. Every call
+// passes its arguments as a single JSON object.
+type Gateway struct {
+	gateway  *sdk.Gateway
+	contract *sdk.Contract
+}
+
+// New connects to the network. The caller must Close the gateway.
+func New(cfg Config) (*Gateway, error) {
+	wallet, err := sdk.NewFileSystemWallet(cfg.WalletPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening wallet: %v", err)
+	}
+	if !wallet.Exists(cfg.Identity) {
+		return nil, fmt.Errorf("identity %s not found in wallet %s", cfg.Identity, cfg.WalletPath)
+	}
+	gw, err := sdk.Connect(
+		sdk.WithConfig(config.FromFile(filepath.Clean(cfg.ConnectionProfile))),
+		sdk.WithIdentity(wallet, cfg.Identity),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to gateway: %v", err)
+	}
+	network, err := gw.GetNetwork(cfg.Channel)
+	if err != nil {
+		gw.Close()
+		return nil, fmt.Errorf("getting channel %s: %v", cfg.Channel, err)
+	}
+	return &Gateway{gateway: gw, contract: network.GetContract(cfg.Chaincode)}, nil
+}
+
+// Submit endorses, orders and commits a transaction.
+func (g *Gateway) Submit(function string, args map[string]interface{}) ([]byte, error) {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	result, err := g.contract.SubmitTransaction(function, string(argsJSON))
+	return result, client.ParseError(err)
+}
+
+// Evaluate queries a peer.
+func (g *Gateway) Evaluate(function string, args map[string]interface{}) ([]byte, error) {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	result, err := g.contract.EvaluateTransaction(function, string(argsJSON))
+	return result, client.ParseError(err)
+}
+
+// Close releases the connection.
+func (g *Gateway) Close() {
+	g.gateway.Close()
+}
@@ -0,0 +1,179 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package memory is the client Backend running the chaincode in process against an
+// in-memory ledger, for development and tests without a Fabric network.
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ddhruvkr/Consentio/client"
+	"github.com/ddhruvkr/Consentio/iws"
+	"github.com/ddhruvkr/Consentio/memstub"
+	"github.com/ddhruvkr/Consentio/rws"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Config describes an in-memory channel. A new channel is governed by Org1MSP and
+// has the watchdogs registered, bound to Org2MSP.
+type Config struct {
+	Design        string   // chaincode design, iws or rws
+	StateFile     string   // file the ledger is loaded from and saved to after each commit; empty to keep it in memory only
+	Identity      string   // admin, custodian, watchdog, consumer or patient:<id>
+	Watchdogs     []string // watchdog ids registered on a new channel
+	WatchdogRoles []string // roles the watchdogs govern
+}
+
+// Memory is a Backend running one design of the chaincode. Like the gateway, every call
+// passes its arguments as a single JSON object.
+type Memory struct {
+	mu       sync.Mutex
+	cfg      Config
+	ledger   *memstub.Ledger
+	cc       shim.Chaincode
+	identity *memstub.Identity
+}
+
+// New loads the ledger from cfg.StateFile, or initialises a new channel when there is
+// none.
+func New(cfg Config) (*Memory, error) {
+	m := &Memory{cfg: cfg}
+	switch cfg.Design {
+	case "iws":
+		m.cc = new(iws.SimpleChaincode)
+	case "rws":
+		m.cc = new(rws.SimpleChaincode)
+	default:
+		return nil, fmt.Errorf("design must be iws or rws")
+	}
+	var err error
+	m.identity, err = memoryIdentity(cfg.Identity)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StateFile != "" {
+		file, err := os.Open(cfg.StateFile)
+		if err == nil {
+			defer file.Close()
+			m.ledger, err = memstub.Load(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", cfg.StateFile, err)
+			}
+			return m, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	m.ledger = memstub.NewLedger()
+	admin, err := memoryIdentity("admin")
+	if err != nil {
+		return nil, err
+	}
+	var response pb.Response
+	quiet(func() { response = m.ledger.Init(m.cc, admin, "Org1MSP") })
+	if response.Status != shim.OK {
+		return nil, client.ParseError(errors.New(response.Message))
+	}
+	for _, watchdog := range cfg.Watchdogs {
+		quiet(func() {
+			response, _ = m.ledger.Invoke(m.cc, admin, nil, "registerWatchdog", watchdog, "Org2MSP", "", strings.Join(cfg.WatchdogRoles, ","))
+		})
+		if response.Status != shim.OK {
+			return nil, client.ParseError(errors.New(response.Message))
+		}
+	}
+	return m, m.save()
+}
+
+// quiet runs the chaincode with standard output discarded: the chaincode logs there, and
+// there the command-line client prints its results.
+func quiet(run func()) {
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err == nil {
+		os.Stdout = devNull
+		defer func() {
+			os.Stdout = stdout
+			devNull.Close()
+		}()
+	}
+	run()
+}
+
+// memoryIdentity returns the local identity of a name: admin is a client of the governing
+// MSP without a role.
+func memoryIdentity(name string) (*memstub.Identity, error) {
+	switch {
+	case name == "admin":
+		return memstub.NewIdentity("Org1MSP", name, nil)
+	case name == "custodian":
+		return memstub.NewIdentity("Org1MSP", name, map[string]string{"consentio.role": "custodian"})
+	case name == "watchdog":
+		return memstub.NewIdentity("Org2MSP", name, map[string]string{"consentio.role": "watchdog"})
+	case name == "consumer":
+		return memstub.NewIdentity("Org3MSP", name, map[string]string{"consentio.role": "consumer", "consentio.consumer_id": name})
+	case strings.HasPrefix(name, "patient:") && len(name) > len("patient:"):
+		return memstub.NewIdentity("Org1MSP", name, map[string]string{"consentio.role": "patient", "consentio.patient_id": name[len("patient:"):]})
+	}
+	return nil, fmt.Errorf("identity %q must be admin, custodian, watchdog, consumer or patient:<id>", name)
+}
+
+func (m *Memory) save() error {
+	if m.cfg.StateFile == "" {
+		return nil
+	}
+	file, err := os.Create(m.cfg.StateFile)
+	if err != nil {
+		return err
+	}
+	err = m.ledger.Save(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Submit invokes the chaincode and commits the transaction when it succeeds.
+func (m *Memory) Submit(function string, args map[string]interface{}) ([]byte, error) {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var response pb.Response
+	quiet(func() { response, _ = m.ledger.Invoke(m.cc, m.identity, nil, function, string(argsJSON)) })
+	if response.Status != shim.OK {
+		return nil, client.ParseError(errors.New(response.Message))
+	}
+	return response.Payload, m.save()
+}
+
+// Evaluate invokes the chaincode without committing anything.
+func (m *Memory) Evaluate(function string, args map[string]interface{}) ([]byte, error) {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var response pb.Response
+	quiet(func() { response, _ = m.ledger.Endorse(m.cc, m.identity, nil, function, string(argsJSON)) })
+	if response.Status != shim.OK {
+		return nil, client.ParseError(errors.New(response.Message))
+	}
+	return response.Payload, nil
+}
+
+// Close saves nothing more: every commit has been saved already. It is there so that a
+// Memory can stand in for a gateway.
+func (m *Memory) Close() {}
@@ -0,0 +1,71 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package memory
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ddhruvkr/Consentio/client"
+)
+
+func open(t *testing.T, state, identity string) *client.Client {
+	t.Helper()
+	m, err := New(Config{Design: "iws", StateFile: state, Identity: identity,
+		Watchdogs: []string{"hippa"}, WatchdogRoles: []string{"all"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.New(m)
+}
+
+func TestStateFileSharedByIdentities(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state.json")
+	consent := client.Consent{PatientID: "2", RoleID: "all", StartDate: "20200101", EndDate: "20991231",
+		ColumnIDs: []string{"103"}, WatchdogID: "hippa"}
+	_, err := open(t, state, "custodian").Grant(consent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = open(t, state, "watchdog").ApproveRole("hippa", "all", "consumer", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, err := open(t, state, "consumer").CheckAccess(client.AccessRequest{RoleID: "all", StartDate: "20200101",
+		EndDate: "20991231", ColumnIDs: []string{"103"}, WatchdogID: "hippa", ConsumerID: "consumer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Granted {
+		t.Errorf("decision = %+v, want granted", decision)
+	}
+	history, err := open(t, state, "patient:2").History(consent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("history has %d entries, want 1", len(history))
+	}
+}
+
+func TestChaincodeErrors(t *testing.T) {
+	_, err := open(t, "", "patient:3").Grant(client.Consent{PatientID: "2", RoleID: "all", StartDate: "20200101",
+		ColumnIDs: []string{"103"}, WatchdogID: "hippa"})
+	cerr, ok := err.(*client.Error)
+	if !ok || cerr.Code != "UNAUTHORIZED" {
+		t.Errorf("grant for another patient: %v, want UNAUTHORIZED", err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	_, err := New(Config{Design: "tws", Identity: "admin"})
+	if err == nil {
+		t.Errorf("unknown design accepted")
+	}
+	_, err = New(Config{Design: "rws", Identity: "patient:"})
+	if err == nil {
+		t.Errorf("patient without an id accepted")
+	}
+}
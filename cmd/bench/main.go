@@ -0,0 +1,314 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command bench runs a workload produced by cmd/workload through both chaincode designs
+// in process, on the in-memory ledger of the memstub package, and reports for each
+// design the throughput, the read and write set sizes, the MVCC conflict rate and the
+// size of the resulting state.
+//
+// The operations are cut into blocks. Every transaction of a block is endorsed by the
+// chaincode itself against the state as of the start of the block, and the block is then
+// committed with Fabric's validation rule: a transaction that read a key written by an
+// earlier valid transaction of the block is invalid and its writes are dropped. An
+// operation the chaincode rejects (for example an accessConsent that is denied) is not
+// submitted, as a client would not submit it.
+//
+//	go run cmd/workload/main.go -column-skew 1.2 | go run cmd/bench/main.go -block-size 50
+//
+// Unlike cmd/mvccsim, which models the key layouts of the two designs, bench measures
+// the chaincode: the read and write sets include every key it touches, such as access
+// logs and certificates, and the throughput is that of endorsing and committing in one
+// process, without a network, signatures or a state database.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ddhruvkr/Consentio/iws"
+	"github.com/ddhruvkr/Consentio/memstub"
+	"github.com/ddhruvkr/Consentio/rws"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// invocation is one chaincode call with named arguments, as written by cmd/workload.
+type invocation struct {
+	Function string            `json:"function"`
+	Args     map[string]string `json:"args"`
+}
+
+type watchdogSetup struct {
+	WatchdogID string   `json:"watchdog_id"`
+	RoleIDs    []string `json:"role_ids"`
+}
+
+type workload struct {
+	Watchdogs  []watchdogSetup `json:"watchdogs"`
+	Approvals  []invocation    `json:"approvals"`
+	Operations []invocation    `json:"operations"`
+}
+
+// design is one chaincode design. RWS has no role approvals and takes no consumer id.
+type design struct {
+	name      string
+	cc        shim.Chaincode
+	approvals bool
+	consumer  bool
+}
+
+var designs = []design{
+	{"IWS", new(iws.SimpleChaincode), true, true},
+	{"RWS", new(rws.SimpleChaincode), false, false},
+}
+
+// clock is inside the consent windows of cmd/workload, which start in 2020.
+func clock() time.Time { return time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+type identities struct {
+	admin, custodian, watchdog *memstub.Identity
+	consumers                  map[string]*memstub.Identity
+}
+
+// consumer returns the identity of the data consumer dc_id, whose certificate names it.
+func (ids *identities) consumer(dc_id string) (*memstub.Identity, error) {
+	id, ok := ids.consumers[dc_id]
+	if !ok {
+		var err error
+		id, err = memstub.NewIdentity("Org3MSP", "bench-consumer-"+dc_id,
+			map[string]string{"consentio.role": "consumer", "consentio.consumer_id": dc_id})
+		if err != nil {
+			return nil, err
+		}
+		ids.consumers[dc_id] = id
+	}
+	return id, nil
+}
+
+func newIdentities() (*identities, error) {
+	ids := &identities{consumers: make(map[string]*memstub.Identity)}
+	var err error
+	for _, id := range []struct {
+		target **memstub.Identity
+		mspID  string
+		role   string
+	}{
+		{&ids.admin, "Org1MSP", ""},
+		{&ids.custodian, "Org1MSP", "custodian"},
+		{&ids.watchdog, "Org2MSP", "watchdog"},
+	} {
+		var attrs map[string]string
+		if id.role != "" {
+			attrs = map[string]string{"consentio.role": id.role}
+		}
+		*id.target, err = memstub.NewIdentity(id.mspID, "bench-"+id.role, attrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// report is the outcome of running the workload on one design.
+type report struct {
+	Design       string  `json:"design"`
+	Blocks       int     `json:"blocks"`
+	Operations   int     `json:"operations"`
+	Rejected     int     `json:"rejected"`
+	Submitted    int     `json:"submitted"`
+	Valid        int     `json:"valid"`
+	Invalid      int     `json:"invalid"`
+	ConflictRate float64 `json:"conflict_rate"`
+	AvgReadSet   float64 `json:"avg_read_set"`
+	AvgWriteSet  float64 `json:"avg_write_set"`
+	Seconds      float64 `json:"seconds"`
+	OpsPerSec    float64 `json:"ops_per_sec"`
+	StateKeys    int     `json:"state_keys"`
+	StateBytes   int     `json:"state_bytes"`
+}
+
+// quiet runs the chaincode with standard output discarded: the chaincode logs there, and
+// there the reports are printed.
+func quiet(run func() error) error {
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err == nil {
+		os.Stdout = devNull
+		defer func() {
+			os.Stdout = stdout
+			devNull.Close()
+		}()
+	}
+	return run()
+}
+
+func invoke(l *memstub.Ledger, d design, id *memstub.Identity, args ...string) error {
+	response, _ := l.Invoke(d.cc, id, nil, args...)
+	if response.Status != shim.OK {
+		return fmt.Errorf("%s %s: %s", d.name, args[0], response.Message)
+	}
+	return nil
+}
+
+// setup initialises a ledger and registers the watchdogs of the workload, bound to
+// Org2MSP, and their role approvals.
+func setup(d design, ids *identities, w *workload) (*memstub.Ledger, error) {
+	l := memstub.NewLedger()
+	l.Clock = clock
+	response := l.Init(d.cc, ids.admin, "Org1MSP")
+	if response.Status != shim.OK {
+		return nil, fmt.Errorf("%s Init: %s", d.name, response.Message)
+	}
+	for _, wd := range w.Watchdogs {
+		err := invoke(l, d, ids.admin, "registerWatchdog", wd.WatchdogID, "Org2MSP", "", strings.Join(wd.RoleIDs, ","))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !d.approvals {
+		return l, nil
+	}
+	for _, approval := range w.Approvals {
+		argsJSON, _ := json.Marshal(approval.Args)
+		err := invoke(l, d, ids.watchdog, approval.Function, string(argsJSON))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func run(d design, ids *identities, w *workload, ops []invocation, blockSize int) (report, error) {
+	r := report{Design: d.name}
+	l, err := setup(d, ids, w)
+	if err != nil {
+		return r, err
+	}
+	reads, writes := 0, 0
+	started := time.Now()
+	for start := 0; start < len(ops); start += blockSize {
+		end := start + blockSize
+		if end > len(ops) {
+			end = len(ops)
+		}
+		r.Blocks++
+		// endorse every transaction of the block against the same state
+		var txs []*memstub.Tx
+		for _, op := range ops[start:end] {
+			r.Operations++
+			args := make(map[string]string)
+			for name, value := range op.Args {
+				if name != "consumer_id" || d.consumer {
+					args[name] = value
+				}
+			}
+			argsJSON, _ := json.Marshal(args)
+			id := ids.custodian
+			if op.Function == "accessConsent" {
+				id, err = ids.consumer(op.Args["consumer_id"])
+				if err != nil {
+					return r, err
+				}
+			}
+			response, tx := l.Endorse(d.cc, id, nil, op.Function, string(argsJSON))
+			if response.Status != shim.OK {
+				r.Rejected++
+				continue
+			}
+			reads += len(tx.ReadSet())
+			writes += len(tx.WriteSet())
+			txs = append(txs, tx)
+		}
+		for _, valid := range l.CommitBlock(txs) {
+			r.Submitted++
+			if valid {
+				r.Valid++
+			} else {
+				r.Invalid++
+			}
+		}
+	}
+	r.Seconds = time.Since(started).Seconds()
+	if r.Seconds > 0 {
+		r.OpsPerSec = float64(r.Operations) / r.Seconds
+	}
+	if r.Submitted > 0 {
+		r.ConflictRate = float64(r.Invalid) / float64(r.Submitted)
+		r.AvgReadSet = float64(reads) / float64(r.Submitted)
+		r.AvgWriteSet = float64(writes) / float64(r.Submitted)
+	}
+	r.StateKeys, r.StateBytes = l.Size()
+	return r, nil
+}
+
+func main() {
+	in := flag.String("in", "-", "workload file written by cmd/workload, - for stdin")
+	blockSize := flag.Int("block-size", 100, "transactions per block, all endorsed against the same state")
+	access := flag.Bool("access", true, "include accessConsent transactions")
+	asJSON := flag.Bool("json", false, "print the reports as JSON")
+	flag.Parse()
+	if *blockSize < 1 {
+		fmt.Fprintln(os.Stderr, "block-size must be at least 1")
+		os.Exit(2)
+	}
+
+	var reader io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		reader = f
+	}
+	var w workload
+	err := json.NewDecoder(reader).Decode(&w)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reading workload:", err)
+		os.Exit(1)
+	}
+	var ops []invocation
+	for _, op := range w.Operations {
+		if op.Function == "updateConsent" || (*access && op.Function == "accessConsent") {
+			ops = append(ops, op)
+		}
+	}
+	ids, err := newIdentities()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var reports []report
+	for _, d := range designs {
+		var r report
+		err = quiet(func() (err error) {
+			r, err = run(d, ids, &w, ops, *blockSize)
+			return err
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		reports = append(reports, r)
+	}
+	if *asJSON {
+		err = json.NewEncoder(os.Stdout).Encode(reports)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Printf("%-6s %7s %8s %7s %7s %9s %8s %8s %10s %10s %10s\n", "design", "ops", "rejected", "valid", "invalid", "conflict", "avg-rs", "avg-ws", "ops/s", "state-keys", "state-B")
+	for _, r := range reports {
+		fmt.Printf("%-6s %7d %8d %7d %7d %8.2f%% %8.2f %8.2f %10.0f %10d %10d\n", r.Design, r.Operations, r.Rejected, r.Valid, r.Invalid,
+			100*r.ConflictRate, r.AvgReadSet, r.AvgWriteSet, r.OpsPerSec, r.StateKeys, r.StateBytes)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func grant(p_id string, column_ids string) invocation {
+	return invocation{"updateConsent", map[string]string{"patient_id": p_id, "action": "g", "role_id": "r0",
+		"start_date": "20200101", "end_date": "20210101", "column_ids": column_ids, "watchdog_id": "w0"}}
+}
+
+// Two patients granting the same column in one block conflict on the column key of IWS,
+// but not under RWS, which keeps a key per patient.
+func TestHotColumnConflictsOnlyInIWS(t *testing.T) {
+	ids, err := newIdentities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &workload{Watchdogs: []watchdogSetup{{"w0", []string{"r0"}}},
+		Approvals: []invocation{{"updateRole", map[string]string{"watchdog_id": "w0", "role_id": "r0", "consumer_id": "dc0", "action": "g"}}}}
+	ops := []invocation{grant("1", "100"), grant("2", "100"), grant("3", "101")}
+	want := map[string][2]int{"IWS": {2, 1}, "RWS": {3, 0}}
+	for _, d := range designs {
+		r, err := run(d, ids, w, ops, len(ops))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rejected != 0 || [2]int{r.Valid, r.Invalid} != want[d.name] {
+			t.Errorf("%s: %d valid, %d invalid, %d rejected, want %v", d.name, r.Valid, r.Invalid, r.Rejected, want[d.name])
+		}
+		if r.AvgWriteSet == 0 || r.StateKeys == 0 {
+			t.Errorf("%s: write sets %v, state keys %d", d.name, r.AvgWriteSet, r.StateKeys)
+		}
+	}
+	// in blocks of one transaction nothing conflicts
+	r, err := run(designs[0], ids, w, ops, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Invalid != 0 || r.Blocks != 3 {
+		t.Errorf("blocks of one: %d invalid in %d blocks", r.Invalid, r.Blocks)
+	}
+}
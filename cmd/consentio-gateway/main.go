@@ -0,0 +1,196 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command consentio-gateway serves the Consentio consent operations over HTTP for
+// clients that cannot use the Fabric SDK. Every request is sent to the network with the
+// gateway's own identity, so the service must only be reachable by trusted callers.
+//
+//	POST   /consents                   grant consent, returns the consent id and receipt
+//	DELETE /consents/{id}              revoke it, ?column_ids=a,b for some columns only
+//	POST   /access-checks              evaluate an access request, returns the decision
+//	GET    /patients/{id}/history      changes to one of the patient's consent settings
+//
+// The API is described in openapi.yaml next to this file. Chaincode error codes map to
+// HTTP statuses; a network failure is a 502.
+//
+//	consentio-gateway -listen :8080 -profile connection-org1.yaml -identity appUser
+//
+// Built with -tags memory, it serves the chaincode running in process instead, with the
+// flags of the consentio command (-backend memory, -design, -state, -identity).
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ddhruvkr/Consentio/client"
+	"github.com/ddhruvkr/Consentio/client/backend"
+)
+
+// status is the HTTP status for each chaincode error code.
+var status = map[string]int{
+	"INVALID_ARGUMENT": http.StatusBadRequest,
+	"UNAUTHORIZED":     http.StatusForbidden,
+	"NOT_FOUND":        http.StatusNotFound,
+	"CONFLICT":         http.StatusConflict,
+	"EXPIRED":          http.StatusGone,
+	"INTERNAL":         http.StatusInternalServerError,
+}
+
+type server struct {
+	client *client.Client
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err in the chaincode's error format.
+func writeError(w http.ResponseWriter, err error) {
+	cerr, ok := err.(*client.Error)
+	if !ok {
+		writeJSON(w, http.StatusBadGateway, &client.Error{Code: "UNAVAILABLE", Message: err.Error()})
+		return
+	}
+	code, ok := status[cerr.Code]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, code, cerr)
+}
+
+func badRequest(w http.ResponseWriter, format string, a ...interface{}) {
+	writeJSON(w, http.StatusBadRequest, &client.Error{Code: "INVALID_ARGUMENT", Message: fmt.Sprintf(format, a...)})
+}
+
+// consentID encodes a consent setting and its columns as an opaque URL-safe id.
+func consentID(consent client.Consent) string {
+	consentJSON, _ := json.Marshal(consent)
+	return base64.RawURLEncoding.EncodeToString(consentJSON)
+}
+
+func parseConsentID(id string) (client.Consent, error) {
+	var consent client.Consent
+	consentJSON, err := base64.RawURLEncoding.DecodeString(id)
+	if err == nil {
+		err = json.Unmarshal(consentJSON, &consent)
+	}
+	return consent, err
+}
+
+func list(value string) []string {
+	var ids []string
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// consents handles POST /consents and DELETE /consents/{id}.
+func (s *server) consents(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/consents")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		var consent client.Consent
+		err := json.NewDecoder(r.Body).Decode(&consent)
+		if err != nil {
+			badRequest(w, "Body must be a consent object: %s", err.Error())
+			return
+		}
+		receipt, err := s.client.Grant(consent)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/consents/"+consentID(consent))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"id": consentID(consent), "consent": consent, "receipt": receipt})
+	case strings.HasPrefix(id, "/") && r.Method == http.MethodDelete:
+		consent, err := parseConsentID(id[1:])
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, &client.Error{Code: "NOT_FOUND", Message: "Unknown consent id"})
+			return
+		}
+		if columns := list(r.URL.Query().Get("column_ids")); len(columns) > 0 {
+			consent.ColumnIDs = columns
+		}
+		err = s.client.Revoke(consent)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// accessChecks handles POST /access-checks. A denial is a decision, not an error, so it
+// is returned with status 200.
+func (s *server) accessChecks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	var request client.AccessRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		badRequest(w, "Body must be an access request object: %s", err.Error())
+		return
+	}
+	decision, err := s.client.CheckAccess(request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, decision)
+}
+
+// patients handles GET /patients/{id}/history; the setting is given in the query.
+func (s *server) patients(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/patients/"), "/")
+	if r.Method != http.MethodGet || len(parts) != 2 || parts[0] == "" || parts[1] != "history" {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	history, err := s.client.History(client.Consent{PatientID: parts[0], RoleID: query.Get("role_id"),
+		StartDate: query.Get("start_date"), EndDate: query.Get("end_date"),
+		ColumnIDs: list(query.Get("column_ids")), WatchdogID: query.Get("watchdog_id")})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to serve on")
+	var cfg backend.Config
+	cfg.Register(flag.CommandLine)
+	flag.Parse()
+
+	b, closeBackend, err := backend.Open(&cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeBackend()
+	s := &server{client: client.New(b)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/consents", s.consents)
+	mux.HandleFunc("/consents/", s.consents)
+	mux.HandleFunc("/access-checks", s.accessChecks)
+	mux.HandleFunc("/patients/", s.patients)
+	log.Printf("serving on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
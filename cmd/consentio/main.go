@@ -0,0 +1,305 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command consentio runs the Consentio consent operations against a Fabric network
+// through the SDK gateway, with named flags instead of hand-written argument arrays.
+//
+//	consentio grant -patient 2 -role all -start 20200101 -end 20210101 -columns 103,104 -watchdog hippa
+//	consentio check-access -role all -start 20200101 -end 20210101 -columns 103 -watchdog hippa -consumer dc1
+//
+// The connection is configured with -profile, -wallet, -identity, -channel and
+// -chaincode, which default to the CONSENTIO_PROFILE, CONSENTIO_WALLET,
+// CONSENTIO_IDENTITY, CONSENTIO_CHANNEL and CONSENTIO_CHAINCODE environment variables.
+// Built with -tags memory, the command runs the chaincode (-design iws or rws) in process
+// instead (-backend memory), on a ledger kept in the -state file; -identity then names a
+// local identity: admin, custodian (the default), watchdog, consumer or patient:<id>.
+// Results are printed as a table or, with -output json, as JSON. check-access exits with
+// status 3 when access is denied, verify-receipt when the receipt does not match.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ddhruvkr/Consentio/client"
+	"github.com/ddhruvkr/Consentio/client/backend"
+)
+
+const usage = `usage: consentio <command> [flags]
+
+commands:
+  grant          give a patient's consent on columns
+  revoke         withdraw a patient's consent on columns
+  approve-role   approve (or with -revoke, withdraw) a data consumer for a role
+  check-access   evaluate a data consumer's access request and print the decision
+  history        print the changes to a patient's consent setting
+  verify-receipt check a consent receipt, read from a file or stdin, against the ledger
+
+Run consentio <command> -h for the flags of a command.
+`
+
+// command holds the flags shared by every subcommand.
+type command struct {
+	flags   *flag.FlagSet
+	backend backend.Config
+	output  string
+}
+
+func newCommand(name string) *command {
+	c := &command{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	c.backend.Register(c.flags)
+	c.flags.StringVar(&c.output, "output", "table", "output format, table or json")
+	return c
+}
+
+// connect parses the arguments and opens the backend.
+func (c *command) connect(args []string) (*client.Client, func()) {
+	c.flags.Parse(args)
+	if c.output != "table" && c.output != "json" {
+		fail(fmt.Errorf("output must be table or json"))
+	}
+	b, closeBackend, err := backend.Open(&c.backend)
+	if err != nil {
+		fail(err)
+	}
+	return client.New(b), closeBackend
+}
+
+// print writes v as JSON, or calls table when the output is a table.
+func (c *command) print(v interface{}, table func(w *tabwriter.Writer)) {
+	if c.output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(v)
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	w.Flush()
+}
+
+func fail(err error) {
+	if cerr, ok := err.(*client.Error); ok && len(cerr.Details) > 0 {
+		fmt.Fprintf(os.Stderr, "consentio: %v\n%s\n", err, cerr.Details)
+	} else {
+		fmt.Fprintf(os.Stderr, "consentio: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+func columns(list string) []string {
+	var ids []string
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// consentFlags registers the flags naming a consent setting.
+func consentFlags(c *command) (patient, role, start, end, cols, watchdog *string) {
+	patient = c.flags.String("patient", "", "patient id")
+	role = c.flags.String("role", "", "role id")
+	start = c.flags.String("start", "", "start date, YYYYMMDD")
+	end = c.flags.String("end", "", "end date, YYYYMMDD (optional)")
+	cols = c.flags.String("columns", "", "comma-separated column ids")
+	watchdog = c.flags.String("watchdog", "", "watchdog id")
+	return
+}
+
+func updateConsent(name string, args []string) {
+	c := newCommand(name)
+	patient, role, start, end, cols, watchdog := consentFlags(c)
+	var receiptFile *string
+	if name == "grant" {
+		receiptFile = c.flags.String("receipt", "", "file to save the consent receipt in, as issued")
+	}
+	cc, closeBackend := c.connect(args)
+	defer closeBackend()
+	consent := client.Consent{PatientID: *patient, RoleID: *role, StartDate: *start, EndDate: *end,
+		ColumnIDs: columns(*cols), WatchdogID: *watchdog}
+	var receipt json.RawMessage
+	var err error
+	past := "granted"
+	if name == "grant" {
+		receipt, err = cc.Grant(consent)
+	} else {
+		err = cc.Revoke(consent)
+		past = "revoked"
+	}
+	if err != nil {
+		fail(err)
+	}
+	if name == "grant" && receipt == nil {
+		past = "already granted"
+	}
+	// printing reformats the receipt, so it is saved byte for byte for verify-receipt
+	if receiptFile != nil && *receiptFile != "" && receipt != nil {
+		err = ioutil.WriteFile(*receiptFile, receipt, 0644)
+		if err != nil {
+			fail(err)
+		}
+	}
+	result := map[string]interface{}{"status": "ok", "action": name, "patient_id": *patient}
+	if receipt != nil {
+		result["receipt"] = receipt
+	}
+	c.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "%s consent of patient %s on columns %s\n", past, *patient, *cols)
+		if receipt != nil {
+			fmt.Fprintf(w, "receipt: %s\n", receipt)
+		}
+	})
+}
+
+func approveRole(args []string) {
+	c := newCommand("approve-role")
+	watchdog := c.flags.String("watchdog", "", "watchdog id")
+	role := c.flags.String("role", "", "role id")
+	consumer := c.flags.String("consumer", "", "data consumer id")
+	revoke := c.flags.Bool("revoke", false, "withdraw the approval instead of granting it")
+	end := c.flags.String("end", "", "last day of the approval, YYYYMMDD (IWS only)")
+	cc, closeBackend := c.connect(args)
+	defer closeBackend()
+	var err error
+	if *end != "" && !*revoke {
+		err = cc.ApproveRoleUntil(*watchdog, *role, *consumer, *end)
+	} else {
+		err = cc.ApproveRole(*watchdog, *role, *consumer, !*revoke)
+	}
+	if err != nil {
+		fail(err)
+	}
+	result := map[string]interface{}{"status": "ok", "role_id": *role, "consumer_id": *consumer, "approved": !*revoke}
+	c.print(result, func(w *tabwriter.Writer) {
+		if *revoke {
+			fmt.Fprintf(w, "withdrew approval of %s for role %s\n", *consumer, *role)
+		} else {
+			fmt.Fprintf(w, "approved %s for role %s\n", *consumer, *role)
+		}
+	})
+}
+
+func checkAccess(args []string) {
+	c := newCommand("check-access")
+	role := c.flags.String("role", "", "role id")
+	start := c.flags.String("start", "", "start date, YYYYMMDD")
+	end := c.flags.String("end", "", "end date, YYYYMMDD")
+	cols := c.flags.String("columns", "", "comma-separated column ids")
+	watchdog := c.flags.String("watchdog", "", "watchdog id")
+	consumer := c.flags.String("consumer", "", "data consumer id (IWS only)")
+	cc, closeBackend := c.connect(args)
+	decision, err := cc.CheckAccess(client.AccessRequest{RoleID: *role, StartDate: *start, EndDate: *end,
+		ColumnIDs: columns(*cols), WatchdogID: *watchdog, ConsumerID: *consumer})
+	closeBackend()
+	if err != nil {
+		fail(err)
+	}
+	c.print(decision, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "STEP\tRESULT\tDETAIL")
+		for _, step := range decision.Steps {
+			result := "pass"
+			if !step.Passed {
+				result = "FAIL " + step.Code
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", step.Step, result, step.Detail)
+		}
+		if decision.Granted {
+			fmt.Fprintln(w, "\ndecision: GRANTED")
+		} else {
+			fmt.Fprintf(w, "\ndecision: DENIED (%s: %s)\n", decision.Code, decision.Reason)
+		}
+	})
+	if !decision.Granted {
+		os.Exit(3)
+	}
+}
+
+func history(args []string) {
+	c := newCommand("history")
+	patient, role, start, end, cols, watchdog := consentFlags(c)
+	cc, closeBackend := c.connect(args)
+	defer closeBackend()
+	entries, err := cc.History(client.Consent{PatientID: *patient, RoleID: *role, StartDate: *start, EndDate: *end,
+		ColumnIDs: columns(*cols), WatchdogID: *watchdog})
+	if err != nil {
+		fail(err)
+	}
+	c.print(entries, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "TIMESTAMP\tTRANSACTION\tCOLUMNS")
+		for _, entry := range entries {
+			consented := strings.Join(entry.ColumnIDs, ",")
+			if consented == "" {
+				consented = "(none)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", entry.Timestamp, entry.TxID, consented)
+		}
+	})
+}
+
+func verifyReceipt(args []string) {
+	c := newCommand("verify-receipt")
+	in := c.flags.String("in", "-", "receipt file, - for stdin")
+	cc, closeBackend := c.connect(args)
+	defer closeBackend()
+	var receipt []byte
+	var err error
+	if *in == "-" {
+		receipt, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		receipt, err = ioutil.ReadFile(*in)
+	}
+	if err != nil {
+		fail(err)
+	}
+	match, err := cc.VerifyReceipt(bytes.TrimSpace(receipt))
+	if err != nil {
+		fail(err)
+	}
+	c.print(map[string]bool{"match": match}, func(w *tabwriter.Writer) {
+		if match {
+			fmt.Fprintln(w, "receipt matches the ledger")
+		} else {
+			fmt.Fprintln(w, "receipt does NOT match the ledger")
+		}
+	})
+	if !match {
+		os.Exit(3)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "grant", "revoke":
+		updateConsent(os.Args[1], args)
+	case "approve-role":
+		approveRole(args)
+	case "check-access":
+		checkAccess(args)
+	case "history":
+		history(args)
+	case "verify-receipt":
+		verifyReceipt(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "consentio: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,334 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command mvccsim estimates how many Consentio transactions Fabric would invalidate with
+// MVCC read conflicts under each key layout, without a network.
+//
+// It reads a workload produced by cmd/workload and cuts its operations into blocks. Every
+// transaction of a block is endorsed against the state as of the start of the block,
+// which gives its read set and write set under the IWS layout (one key per column and
+// setting, holding the consented patients) and the RWS layout (one key per patient and
+// setting, holding the consented columns). Transactions are then validated in block order
+// with Fabric's rule: a transaction is invalid if it read a key that an earlier valid
+// transaction of the same block wrote. Only the writes of valid transactions are
+// committed.
+//
+//	go run cmd/workload/main.go -column-skew 1.2 | go run cmd/mvccsim/main.go -block-size 50
+//
+// The key sets follow the chaincode's updateConsent and accessConsent; the watchdog
+// record each of them reads is included, role approvals are assumed to be in place.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// invocation is one chaincode call with named arguments, as written by cmd/workload.
+type invocation struct {
+	Function string            `json:"function"`
+	Args     map[string]string `json:"args"`
+}
+
+type workload struct {
+	Operations []invocation `json:"operations"`
+}
+
+// state maps each key to the sorted members of its record: patients for IWS, columns
+// for RWS. A key without members does not exist.
+type state map[string][]string
+
+// txResult is the endorsement of one transaction against a snapshot. A nil value in
+// writes deletes the key.
+type txResult struct {
+	reads  []string
+	writes map[string][]string
+}
+
+// layout endorses one invocation against a snapshot.
+type layout struct {
+	name     string
+	simulate func(snapshot state, op invocation) txResult
+	size     func(key string, members []string) int
+}
+
+// watchdogKey is the composite key of the watchdog record read by every consent function.
+func watchdogKey(w_id string) string {
+	return "\x00watchdog\x00" + w_id + "\x00"
+}
+
+const indexPrefix = "\x00patient~consent\x00"
+
+// indexKey is the composite key of a patient index entry.
+func indexKey(attributes ...string) string {
+	return indexPrefix + strings.Join(attributes, "\x00") + "\x00"
+}
+
+// ids lower-cases the identifying arguments the way the chaincode does.
+func ids(op invocation) (p_id, action, r_id, s_date, e_date, w_id, dc_id string, c_ids []string) {
+	a := op.Args
+	for _, c_id := range strings.Split(a["column_ids"], ",") {
+		if c_id != "" {
+			c_ids = append(c_ids, c_id)
+		}
+	}
+	return strings.ToLower(a["patient_id"]), strings.ToLower(a["action"]), strings.ToLower(a["role_id"]),
+		strings.ToLower(a["start_date"]), strings.ToLower(a["end_date"]), strings.ToLower(a["watchdog_id"]),
+		strings.ToLower(a["consumer_id"]), c_ids
+}
+
+func indexOf(s []string, e string) int {
+	for i, a := range s {
+		if a == e {
+			return i
+		}
+	}
+	return -1
+}
+
+// with returns a sorted copy of s including e.
+func with(s []string, e string) []string {
+	out := append(append([]string{}, s...), e)
+	sort.Strings(out)
+	return out
+}
+
+// without returns a copy of s without e, or nil when nothing is left.
+func without(s []string, e string) []string {
+	var out []string
+	for _, a := range s {
+		if a != e {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// iws: updateConsent reads every column key and rewrites the ones whose patient set
+// changes, with their patient index entries; accessConsent reads the role approval and every column key.
+var iws = layout{
+	name: "IWS",
+	simulate: func(snapshot state, op invocation) txResult {
+		p_id, action, r_id, s_date, e_date, w_id, dc_id, c_ids := ids(op)
+		tx := txResult{reads: []string{watchdogKey(w_id)}, writes: make(map[string][]string)}
+		if op.Function == "accessConsent" {
+			tx.reads = append(tx.reads, w_id+r_id+dc_id)
+		}
+		for _, c_id := range c_ids {
+			unq_id := c_id + r_id + s_date + e_date + w_id
+			tx.reads = append(tx.reads, unq_id)
+			if op.Function != "updateConsent" {
+				continue
+			}
+			patients := snapshot[unq_id]
+			if action == "g" && indexOf(patients, p_id) == -1 {
+				tx.writes[unq_id] = with(patients, p_id)
+				tx.writes[indexKey(p_id, r_id, s_date, e_date, w_id, c_id)] = []string{p_id}
+			} else if action == "r" && indexOf(patients, p_id) != -1 {
+				tx.writes[unq_id] = without(patients, p_id)
+				tx.writes[indexKey(p_id, r_id, s_date, e_date, w_id, c_id)] = nil
+			}
+		}
+		return tx
+	},
+	size: func(key string, members []string) int {
+		u_ids := make(map[string]int)
+		for _, p_id := range members {
+			u_ids[p_id] = 1
+		}
+		valueAsBytes, _ := json.Marshal(map[string]interface{}{"u_ids": u_ids})
+		return len(key) + len(valueAsBytes)
+	},
+}
+
+// rwsUsers are the patients accessConsent reads in the RWS chaincode.
+var rwsUsers = func() []string {
+	var s []string
+	for i := 0; i < 100; i++ {
+		s = append(s, strconv.Itoa(i))
+	}
+	return s
+}()
+
+// rws: updateConsent reads the patient's key and rewrites it whenever it exists (even if
+// no column changed) or is created, writing its patient index entry when it is created or
+// deleted; accessConsent reads the key of each of the 100
+// patients it checks.
+var rws = layout{
+	name: "RWS",
+	simulate: func(snapshot state, op invocation) txResult {
+		p_id, action, r_id, s_date, e_date, w_id, _, c_ids := ids(op)
+		tx := txResult{reads: []string{watchdogKey(w_id)}, writes: make(map[string][]string)}
+		if op.Function == "accessConsent" {
+			for _, u_id := range rwsUsers {
+				tx.reads = append(tx.reads, u_id+r_id+s_date+e_date+w_id)
+			}
+			return tx
+		}
+		if op.Function != "updateConsent" {
+			return tx
+		}
+		unq_id := p_id + r_id + s_date + e_date + w_id
+		tx.reads = append(tx.reads, unq_id)
+		columns, exists := snapshot[unq_id]
+		if !exists && action != "g" {
+			return tx
+		}
+		for _, c_id := range c_ids {
+			if action == "g" && indexOf(columns, c_id) == -1 {
+				columns = with(columns, c_id)
+			} else if action == "r" && indexOf(columns, c_id) != -1 {
+				columns = without(columns, c_id)
+			}
+		}
+		tx.writes[unq_id] = columns
+		if !exists || len(columns) == 0 {
+			tx.writes[indexKey(p_id, r_id, s_date, e_date, w_id)] = columns
+		}
+		return tx
+	},
+	size: func(key string, members []string) int {
+		// the record repeats the setting next to the columns
+		valueAsBytes, _ := json.Marshal(map[string]interface{}{"u_id": "", "r_id": "", "s_date": "", "e_date": "", "c_ids": members, "acctype_id": ""})
+		return 2*len(key) + len(valueAsBytes)
+	},
+}
+
+// report is the outcome of replaying the workload under one layout.
+type report struct {
+	Layout         string  `json:"layout"`
+	Blocks         int     `json:"blocks"`
+	Transactions   int     `json:"transactions"`
+	Valid          int     `json:"valid"`
+	Invalid        int     `json:"invalid"`
+	ConflictRate   float64 `json:"conflict_rate"`
+	AvgReadSet     float64 `json:"avg_read_set"`
+	AvgWriteSet    float64 `json:"avg_write_set"`
+	StateKeys      int     `json:"state_keys"`
+	StateBytes     int     `json:"state_bytes"`
+	InvalidUpdates int     `json:"invalid_updates"`
+	InvalidAccess  int     `json:"invalid_access"`
+}
+
+func run(l layout, ops []invocation, blockSize int) report {
+	r := report{Layout: l.name}
+	st := make(state)
+	reads, writes := 0, 0
+	for start := 0; start < len(ops); start += blockSize {
+		end := start + blockSize
+		if end > len(ops) {
+			end = len(ops)
+		}
+		r.Blocks++
+		// endorse every transaction of the block against the same snapshot
+		var txs []txResult
+		for _, op := range ops[start:end] {
+			tx := l.simulate(st, op)
+			reads += len(tx.reads)
+			writes += len(tx.writes)
+			txs = append(txs, tx)
+		}
+		// validate in order, committing the writes of valid transactions
+		written := make(map[string]bool)
+		for i, tx := range txs {
+			r.Transactions++
+			conflict := false
+			for _, key := range tx.reads {
+				if written[key] {
+					conflict = true
+					break
+				}
+			}
+			if conflict {
+				r.Invalid++
+				if ops[start+i].Function == "accessConsent" {
+					r.InvalidAccess++
+				} else {
+					r.InvalidUpdates++
+				}
+				continue
+			}
+			r.Valid++
+			for key, members := range tx.writes {
+				written[key] = true
+				if len(members) == 0 {
+					delete(st, key)
+				} else {
+					st[key] = members
+				}
+			}
+		}
+	}
+	if r.Transactions > 0 {
+		r.ConflictRate = float64(r.Invalid) / float64(r.Transactions)
+		r.AvgReadSet = float64(reads) / float64(r.Transactions)
+		r.AvgWriteSet = float64(writes) / float64(r.Transactions)
+	}
+	r.StateKeys = len(st)
+	for key, members := range st {
+		if strings.HasPrefix(key, indexPrefix) {
+			// index entries hold a single byte
+			r.StateBytes += len(key) + 1
+			continue
+		}
+		r.StateBytes += l.size(key, members)
+	}
+	return r
+}
+
+func main() {
+	in := flag.String("in", "-", "workload file written by cmd/workload, - for stdin")
+	blockSize := flag.Int("block-size", 100, "transactions per block, all endorsed against the same snapshot")
+	access := flag.Bool("access", true, "include accessConsent transactions")
+	asJSON := flag.Bool("json", false, "print the reports as JSON")
+	flag.Parse()
+	if *blockSize < 1 {
+		fmt.Fprintln(os.Stderr, "block-size must be at least 1")
+		os.Exit(2)
+	}
+
+	var reader io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		reader = f
+	}
+	var w workload
+	err := json.NewDecoder(reader).Decode(&w)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reading workload:", err)
+		os.Exit(1)
+	}
+	var ops []invocation
+	for _, op := range w.Operations {
+		if op.Function == "updateConsent" || (*access && op.Function == "accessConsent") {
+			ops = append(ops, op)
+		}
+	}
+
+	reports := []report{run(iws, ops, *blockSize), run(rws, ops, *blockSize)}
+	if *asJSON {
+		err = json.NewEncoder(os.Stdout).Encode(reports)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Printf("%-6s %7s %7s %7s %9s %8s %8s %10s %10s\n", "layout", "txs", "valid", "invalid", "conflict", "avg-rs", "avg-ws", "state-keys", "state-B")
+	for _, r := range reports {
+		fmt.Printf("%-6s %7d %7d %7d %8.2f%% %8.2f %8.2f %10d %10d\n", r.Layout, r.Transactions, r.Valid, r.Invalid,
+			100*r.ConflictRate, r.AvgReadSet, r.AvgWriteSet, r.StateKeys, r.StateBytes)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fixed is a layout whose transactions read and write the keys named by their arguments.
+var fixed = layout{
+	name: "fixed",
+	simulate: func(snapshot state, op invocation) txResult {
+		tx := txResult{writes: make(map[string][]string)}
+		if key := op.Args["read"]; key != "" {
+			tx.reads = append(tx.reads, key)
+		}
+		if key := op.Args["write"]; key != "" {
+			tx.writes[key] = []string{op.Args["value"]}
+		}
+		return tx
+	},
+	size: func(key string, members []string) int { return len(key) },
+}
+
+func op(read, write, value string) invocation {
+	return invocation{"updateConsent", map[string]string{"read": read, "write": write, "value": value}}
+}
+
+func TestReadAfterWriteInBlockIsInvalid(t *testing.T) {
+	ops := []invocation{
+		op("a", "a", "1"),
+		op("a", "b", "2"), // reads a, written earlier in the block
+		op("b", "c", "3"), // b was only written by an invalid transaction
+		op("a", "a", "4"), // next block: sees the committed a
+	}
+	r := run(fixed, ops, 3)
+	if r.Blocks != 2 || r.Valid != 3 || r.Invalid != 1 || r.InvalidUpdates != 1 {
+		t.Errorf("report = %+v, want 2 blocks with 1 invalid update", r)
+	}
+	// the invalid transaction's write of b was not committed
+	if r.StateKeys != 2 {
+		t.Errorf("state has %d keys, want a and c", r.StateKeys)
+	}
+}
+
+func TestIWSColumnContention(t *testing.T) {
+	grant := func(p_id, c_ids string) invocation {
+		return invocation{"updateConsent", map[string]string{"patient_id": p_id, "action": "g", "role_id": "r0",
+			"start_date": "20200101", "end_date": "20210101", "column_ids": c_ids, "watchdog_id": "w0"}}
+	}
+	ops := []invocation{grant("1", "100"), grant("2", "100,101"), grant("3", "101")}
+	if r := run(iws, ops, 3); r.Valid != 2 || r.Invalid != 1 {
+		t.Errorf("IWS = %+v, want the second grant invalid", r)
+	}
+	if r := run(rws, ops, 3); r.Valid != 3 {
+		t.Errorf("RWS = %+v, want all grants valid", r)
+	}
+}
+
+// IWS lower-cases the ids and keeps the patients of a column key sorted.
+func TestIWSGrantAndRevoke(t *testing.T) {
+	unq_id := "100" + "r0" + "20200101" + "20210101" + "w0"
+	snapshot := state{unq_id: {"1"}}
+	args := map[string]string{"patient_id": "2", "action": "g", "role_id": "R0", "start_date": "20200101",
+		"end_date": "20210101", "column_ids": "100", "watchdog_id": "w0"}
+	tx := iws.simulate(snapshot, invocation{"updateConsent", args})
+	if got := tx.writes[unq_id]; !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Errorf("grant writes %v", got)
+	}
+	args["patient_id"] = "1"
+	args["action"] = "r"
+	tx = iws.simulate(snapshot, invocation{"updateConsent", args})
+	if got, ok := tx.writes[unq_id]; !ok || got != nil {
+		t.Errorf("revoke writes %v, want the key deleted", got)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command workload generates synthetic Consentio workloads: a population of patients,
+// columns, roles, watchdogs and data consumers, and a stream of updateConsent and
+// accessConsent invocations over it. Patients and columns can be drawn with a Zipf skew
+// so that a few hot columns (the contended keys of the IWS design) or hot patients (the
+// contended keys of the RWS design) receive most of the updates.
+//
+// Invocations use the chaincode's named JSON arguments, so each one can be replayed with
+// peer chaincode invoke and the grants and revokes can be fed to bulkUpdateConsent.
+//
+//	go run cmd/workload/main.go -patients 1000 -columns 50 -ops 10000 -column-skew 1.2 > workload.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invocation is one chaincode call with named arguments.
+type invocation struct {
+	Function string            `json:"function"`
+	Args     map[string]string `json:"args"`
+}
+
+type watchdogSetup struct {
+	WatchdogID string   `json:"watchdog_id"`
+	RoleIDs    []string `json:"role_ids"`
+}
+
+// workload is written to stdout. The watchdogs have to be registered and the approvals
+// replayed before the operations.
+type workload struct {
+	Seed       int64           `json:"seed"`
+	Patients   int             `json:"patients"`
+	Columns    int             `json:"columns"`
+	Watchdogs  []watchdogSetup `json:"watchdogs"`
+	Approvals  []invocation    `json:"approvals"`
+	Operations []invocation    `json:"operations"`
+}
+
+// chooser draws indexes in [0, n), uniformly or with a Zipf skew.
+type chooser struct {
+	n    int
+	r    *rand.Rand
+	zipf *rand.Zipf
+}
+
+// newChooser returns a uniform chooser when skew is 0. Otherwise skew is the Zipf
+// exponent and must be greater than 1.
+func newChooser(r *rand.Rand, n int, skew float64) (*chooser, error) {
+	c := &chooser{n: n, r: r}
+	if skew != 0 {
+		if skew <= 1 {
+			return nil, fmt.Errorf("skew must be 0 or greater than 1, got %v", skew)
+		}
+		c.zipf = rand.NewZipf(r, skew, 1, uint64(n-1))
+	}
+	return c, nil
+}
+
+func (c *chooser) next() int {
+	if c.zipf != nil {
+		return int(c.zipf.Uint64())
+	}
+	return c.r.Intn(c.n)
+}
+
+// distinct draws k different indexes.
+func (c *chooser) distinct(k int) []int {
+	if k > c.n {
+		k = c.n
+	}
+	seen := make(map[int]bool)
+	var picked []int
+	for len(picked) < k {
+		i := c.next()
+		if !seen[i] {
+			seen[i] = true
+			picked = append(picked, i)
+		}
+	}
+	return picked
+}
+
+func patientID(i int) string  { return strconv.Itoa(i) }
+func columnID(i int) string   { return strconv.Itoa(100 + i) }
+func roleID(i int) string     { return "r" + strconv.Itoa(i) }
+func watchdogID(i int) string { return "w" + strconv.Itoa(i) }
+func consumerID(i int) string { return "dc" + strconv.Itoa(i) }
+
+func main() {
+	patients := flag.Int("patients", 100, "number of patients")
+	columns := flag.Int("columns", 20, "number of columns")
+	roles := flag.Int("roles", 4, "number of roles")
+	watchdogs := flag.Int("watchdogs", 2, "number of watchdogs, roles are spread over them")
+	consumers := flag.Int("consumers", 4, "number of data consumers, each approved for every role")
+	windows := flag.Int("windows", 2, "number of consent windows")
+	ops := flag.Int("ops", 1000, "number of operations")
+	columnsPerOp := flag.Int("columns-per-op", 3, "columns named by each operation")
+	accessRatio := flag.Float64("access-ratio", 0.2, "fraction of operations that are accessConsent")
+	revokeRatio := flag.Float64("revoke-ratio", 0.1, "fraction of consent updates that revoke an earlier grant")
+	patientSkew := flag.Float64("patient-skew", 0, "Zipf exponent for choosing patients, 0 for uniform")
+	columnSkew := flag.Float64("column-skew", 0, "Zipf exponent for choosing columns, 0 for uniform")
+	seed := flag.Int64("seed", 1, "random seed")
+	flag.Parse()
+
+	if *patients < 1 || *columns < 1 || *roles < 1 || *watchdogs < 1 || *consumers < 1 || *windows < 1 {
+		fmt.Fprintln(os.Stderr, "population sizes must be at least 1")
+		os.Exit(2)
+	}
+	r := rand.New(rand.NewSource(*seed))
+	patientChooser, err := newChooser(r, *patients, *patientSkew)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "patient-skew:", err)
+		os.Exit(2)
+	}
+	columnChooser, err := newChooser(r, *columns, *columnSkew)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "column-skew:", err)
+		os.Exit(2)
+	}
+
+	w := workload{Seed: *seed, Patients: *patients, Columns: *columns}
+	for i := 0; i < *watchdogs; i++ {
+		w.Watchdogs = append(w.Watchdogs, watchdogSetup{WatchdogID: watchdogID(i), RoleIDs: []string{}})
+	}
+	// role i is governed by watchdog i mod watchdogs
+	for i := 0; i < *roles; i++ {
+		wd := &w.Watchdogs[i%*watchdogs]
+		wd.RoleIDs = append(wd.RoleIDs, roleID(i))
+		for j := 0; j < *consumers; j++ {
+			w.Approvals = append(w.Approvals, invocation{"updateRole", map[string]string{
+				"watchdog_id": wd.WatchdogID, "role_id": roleID(i), "consumer_id": consumerID(j), "action": "g"}})
+		}
+	}
+	// window i starts i months after 2020-01-01 and lasts a year
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var starts, ends []string
+	for i := 0; i < *windows; i++ {
+		start := first.AddDate(0, i, 0)
+		starts = append(starts, start.Format("20060102"))
+		ends = append(ends, start.AddDate(1, 0, 0).Format("20060102"))
+	}
+
+	var grants []map[string]string
+	for n := 0; n < *ops; n++ {
+		role := r.Intn(*roles)
+		window := r.Intn(*windows)
+		var cols []string
+		for _, c := range columnChooser.distinct(*columnsPerOp) {
+			cols = append(cols, columnID(c))
+		}
+		colList := strings.Join(cols, ",")
+		if r.Float64() < *accessRatio {
+			w.Operations = append(w.Operations, invocation{"accessConsent", map[string]string{
+				"role_id": roleID(role), "start_date": starts[window], "end_date": ends[window],
+				"column_ids": colList, "watchdog_id": watchdogID(role % *watchdogs),
+				"consumer_id": consumerID(r.Intn(*consumers))}})
+			continue
+		}
+		if len(grants) > 0 && r.Float64() < *revokeRatio {
+			i := r.Intn(len(grants))
+			revoke := make(map[string]string)
+			for k, v := range grants[i] {
+				revoke[k] = v
+			}
+			revoke["action"] = "r"
+			grants = append(grants[:i], grants[i+1:]...)
+			w.Operations = append(w.Operations, invocation{"updateConsent", revoke})
+			continue
+		}
+		grant := map[string]string{
+			"patient_id": patientID(patientChooser.next()), "action": "g", "role_id": roleID(role),
+			"start_date": starts[window], "end_date": ends[window], "column_ids": colList,
+			"watchdog_id": watchdogID(role % *watchdogs)}
+		grants = append(grants, grant)
+		w.Operations = append(w.Operations, invocation{"updateConsent", grant})
+	}
+
+	err = json.NewEncoder(os.Stdout).Encode(w)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,43 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestChooser(t *testing.T) {
+	_, err := newChooser(rand.New(rand.NewSource(1)), 10, 0.5)
+	if err == nil {
+		t.Errorf("skew 0.5 accepted")
+	}
+	for _, skew := range []float64{0, 1.2} {
+		c, err := newChooser(rand.New(rand.NewSource(1)), 10, skew)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make([]int, 10)
+		for i := 0; i < 10000; i++ {
+			n := c.next()
+			if n < 0 || n >= 10 {
+				t.Fatalf("skew %v: index %d out of range", skew, n)
+			}
+			counts[n]++
+		}
+		// a skewed chooser draws the first index far more often than the last
+		if skew != 0 && counts[0] < 5*counts[9] {
+			t.Errorf("skew %v: counts %v", skew, counts)
+		}
+		picked := c.distinct(20)
+		seen := make(map[int]bool)
+		for _, n := range picked {
+			seen[n] = true
+		}
+		if len(picked) != 10 || len(seen) != 10 {
+			t.Errorf("skew %v: distinct(20) of 10 = %v", skew, picked)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package equivalence checks that the IWS and RWS designs make the same accessConsent
+// decisions for the same sequence of consent updates, and pins down where they differ:
+// RWS has no role approvals and does not bind requests to a data consumer.
+package equivalence
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddhruvkr/Consentio/iws"
+	"github.com/ddhruvkr/Consentio/memstub"
+	"github.com/ddhruvkr/Consentio/rws"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var (
+	seeds = flag.Int("equivalence.seeds", 5, "number of random operation sequences")
+	ops   = flag.Int("equivalence.ops", 300, "consent updates per sequence")
+)
+
+// The setting every operation uses, and another one nobody consents in.
+const (
+	s_date       = "20150101"
+	e_date       = "20160101"
+	other_e_date = "20151231"
+)
+
+var columns = []string{"101", "102", "103", "104", "105"}
+
+// design is one chaincode on its own ledger.
+type design struct {
+	name   string
+	ledger *memstub.Ledger
+	cc     shim.Chaincode
+	// accessConsent arguments after the watchdog id
+	consumer []string
+}
+
+// decision is what accessConsent returned, in terms both designs share.
+type decision struct {
+	Granted  bool
+	Code     string
+	Columns  map[string]int
+	Patients map[string][]string
+}
+
+type identities struct {
+	admin     *memstub.Identity
+	custodian *memstub.Identity
+	watchdog  *memstub.Identity
+	consumer  *memstub.Identity
+}
+
+func newIdentities(t *testing.T) *identities {
+	ids := &identities{}
+	var err error
+	for _, id := range []struct {
+		target **memstub.Identity
+		mspID  string
+		name   string
+		attrs  map[string]string
+	}{
+		{&ids.admin, "Org1MSP", "admin", nil},
+		{&ids.custodian, "Org1MSP", "custodian", map[string]string{"consentio.role": "custodian"}},
+		{&ids.watchdog, "Org2MSP", "hippa", map[string]string{"consentio.role": "watchdog"}},
+		{&ids.consumer, "Org3MSP", "dc1", map[string]string{"consentio.role": "consumer", "consentio.consumer_id": "dc1"}},
+	} {
+		*id.target, err = memstub.NewIdentity(id.mspID, id.name, id.attrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func (d *design) invoke(t *testing.T, id *memstub.Identity, args ...string) {
+	t.Helper()
+	response, _ := d.ledger.Invoke(d.cc, id, nil, args...)
+	if response.Status != shim.OK {
+		t.Fatalf("%s %v: %s", d.name, args, response.Message)
+	}
+}
+
+// access endorses accessConsent without committing it, so that the access log and
+// certificates of one request do not change the ledger the next one sees.
+func (d *design) access(t *testing.T, id *memstub.Identity, end string, column_ids string) decision {
+	t.Helper()
+	args := append([]string{"accessConsent", "all", s_date, end, column_ids, "hippa"}, d.consumer...)
+	response, _ := d.ledger.Endorse(d.cc, id, nil, args...)
+	return parse(t, d.name, response)
+}
+
+func parse(t *testing.T, name string, response pb.Response) decision {
+	t.Helper()
+	if response.Status != shim.OK {
+		cerr := struct {
+			Code string `json:"code"`
+		}{}
+		err := json.Unmarshal(response.Payload, &cerr)
+		if err != nil {
+			t.Fatalf("%s: error payload %q: %v", name, response.Payload, err)
+		}
+		return decision{Code: cerr.Code}
+	}
+	d := decision{}
+	err := json.Unmarshal(response.Payload, &d)
+	if err != nil {
+		t.Fatalf("%s: trace %q: %v", name, response.Payload, err)
+	}
+	for _, patients := range d.Patients {
+		sort.Strings(patients)
+	}
+	return d
+}
+
+func newDesigns(t *testing.T, ids *identities) []*design {
+	clock := func() time.Time { return time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC) }
+	designs := []*design{
+		{name: "IWS", ledger: memstub.NewLedger(), cc: new(iws.SimpleChaincode), consumer: []string{"dc1"}},
+		{name: "RWS", ledger: memstub.NewLedger(), cc: new(rws.SimpleChaincode)},
+	}
+	for _, d := range designs {
+		d.ledger.Clock = clock
+		response := d.ledger.Init(d.cc, ids.admin, "Org1MSP")
+		if response.Status != shim.OK {
+			t.Fatalf("%s Init: %s", d.name, response.Message)
+		}
+		d.invoke(t, ids.admin, "registerWatchdog", "hippa", "Org2MSP", "", "all")
+	}
+	return designs
+}
+
+// approve has the watchdog approve role all for dc1 in IWS; RWS has no approvals.
+func approve(t *testing.T, ids *identities, designs []*design) {
+	designs[0].invoke(t, ids.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+}
+
+// subset returns a random non-empty subset of columns, comma separated.
+func subset(r *rand.Rand) string {
+	var chosen []string
+	for len(chosen) == 0 {
+		for _, column := range columns {
+			if r.Intn(2) == 0 {
+				chosen = append(chosen, column)
+			}
+		}
+	}
+	return strings.Join(chosen, ",")
+}
+
+func TestAccessConsentDecisionsMatch(t *testing.T) {
+	ids := newIdentities(t)
+	for seed := int64(1); seed <= int64(*seeds); seed++ {
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			r := rand.New(rand.NewSource(seed))
+			designs := newDesigns(t, ids)
+			approve(t, ids, designs)
+			for op := 0; op < *ops; op++ {
+				action := "g"
+				if r.Intn(5) < 2 {
+					action = "r"
+				}
+				args := []string{"updateConsent", strconv.Itoa(r.Intn(100)), action, "all", s_date, e_date, subset(r), "hippa"}
+				for _, d := range designs {
+					d.invoke(t, ids.custodian, args...)
+				}
+				if op%10 != 9 {
+					continue
+				}
+				column_ids := subset(r)
+				end := e_date
+				if r.Intn(10) == 0 {
+					end = other_e_date
+				}
+				iwsDecision := designs[0].access(t, ids.consumer, end, column_ids)
+				rwsDecision := designs[1].access(t, ids.consumer, end, column_ids)
+				if !reflect.DeepEqual(iwsDecision, rwsDecision) {
+					t.Fatalf("after %d operations, accessConsent %s %s:\nIWS %+v\nRWS %+v", op+1, end, column_ids, iwsDecision, rwsDecision)
+				}
+				if !iwsDecision.Granted && iwsDecision.Code != "NOT_FOUND" {
+					t.Fatalf("after %d operations, access to %s denied with %s", op+1, column_ids, iwsDecision.Code)
+				}
+			}
+		})
+	}
+}
+
+// The designs agree on the consents but not on who may use them. Without the watchdog's
+// approval of the consumer IWS refuses access that RWS grants, and only IWS takes the
+// consumer from the caller's certificate, so only IWS refuses a request naming another.
+func TestAccessConsentDivergences(t *testing.T) {
+	ids := newIdentities(t)
+	designs := newDesigns(t, ids)
+	for _, d := range designs {
+		d.invoke(t, ids.custodian, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	}
+	iwsDecision := designs[0].access(t, ids.consumer, e_date, "101")
+	rwsDecision := designs[1].access(t, ids.consumer, e_date, "101")
+	if iwsDecision.Granted || iwsDecision.Code != "UNAUTHORIZED" {
+		t.Errorf("IWS without approval: %+v, want UNAUTHORIZED", iwsDecision)
+	}
+	if !rwsDecision.Granted {
+		t.Errorf("RWS: %+v, want access granted", rwsDecision)
+	}
+	approve(t, ids, designs)
+	if iwsDecision := designs[0].access(t, ids.consumer, e_date, "101"); !reflect.DeepEqual(iwsDecision, rwsDecision) {
+		t.Errorf("with approval:\nIWS %+v\nRWS %+v", iwsDecision, rwsDecision)
+	}
+	designs[0].consumer = []string{"dc2"}
+	if iwsDecision := designs[0].access(t, ids.consumer, e_date, "101"); iwsDecision.Code != "UNAUTHORIZED" {
+		t.Errorf("IWS request naming another consumer: %+v, want UNAUTHORIZED", iwsDecision)
+	}
+	// with nobody consenting both deny alike
+	for _, d := range designs {
+		d.invoke(t, ids.custodian, "updateConsent", "2", "r", "all", s_date, e_date, "101", "hippa")
+	}
+	designs[0].consumer = []string{"dc1"}
+	iwsDecision = designs[0].access(t, ids.consumer, e_date, "101")
+	rwsDecision = designs[1].access(t, ids.consumer, e_date, "101")
+	if iwsDecision.Code != "NOT_FOUND" || !reflect.DeepEqual(iwsDecision, rwsDecision) {
+		t.Errorf("without consent:\nIWS %+v\nRWS %+v", iwsDecision, rwsDecision)
+	}
+}
@@ -0,0 +1,1063 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package iws
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ddhruvkr/Consentio/memstub"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The consent setting most tests use; the ledger clock is inside its window.
+const (
+	s_date = "20150101"
+	e_date = "20160101"
+)
+
+// fixture is a channel governed by Org1MSP with the hippa watchdog (Org2MSP) governing
+// role all, and one client of each role.
+type fixture struct {
+	t         *testing.T
+	ledger    *memstub.Ledger
+	cc        *SimpleChaincode
+	admin     *memstub.Identity // Org1MSP client without attributes
+	custodian *memstub.Identity
+	patient   *memstub.Identity // patient 2
+	watchdog  *memstub.Identity
+	consumer  *memstub.Identity
+}
+
+func identity(t *testing.T, mspID string, name string, attrs map[string]string) *memstub.Identity {
+	id, err := memstub.NewIdentity(mspID, name, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func newFixture(t *testing.T) *fixture {
+	f := &fixture{t: t, ledger: memstub.NewLedger(), cc: new(SimpleChaincode)}
+	f.ledger.Clock = func() time.Time { return time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC) }
+	f.admin = identity(t, "Org1MSP", "admin", nil)
+	f.custodian = identity(t, "Org1MSP", "custodian", map[string]string{"consentio.role": "custodian"})
+	f.patient = identity(t, "Org1MSP", "patient2", map[string]string{"consentio.role": "patient", "consentio.patient_id": "2"})
+	f.watchdog = identity(t, "Org2MSP", "hippa", map[string]string{"consentio.role": "watchdog"})
+	f.consumer = identity(t, "Org3MSP", "dc1", map[string]string{"consentio.role": "consumer", "consentio.consumer_id": "dc1"})
+	response := f.ledger.Init(f.cc, f.admin, "Org1MSP")
+	if response.Status != shim.OK {
+		t.Fatalf("Init: %s", response.Message)
+	}
+	f.ok(f.admin, "registerWatchdog", "hippa", "Org2MSP", "", "all")
+	return f
+}
+
+// invoke endorses the call and commits it when it succeeds.
+func (f *fixture) invoke(id *memstub.Identity, args ...string) (pb.Response, *memstub.Tx) {
+	return f.ledger.Invoke(f.cc, id, nil, args...)
+}
+
+// ok invokes a call that must succeed and returns its payload.
+func (f *fixture) ok(id *memstub.Identity, args ...string) []byte {
+	f.t.Helper()
+	response, _ := f.invoke(id, args...)
+	if response.Status != shim.OK {
+		f.t.Fatalf("%v: %s", args, response.Message)
+	}
+	return response.Payload
+}
+
+// fails invokes a call that must fail with the given error code.
+func (f *fixture) fails(code string, id *memstub.Identity, args ...string) {
+	f.t.Helper()
+	response, _ := f.invoke(id, args...)
+	if response.Status == shim.OK {
+		f.t.Fatalf("%v succeeded, want %s", args, code)
+	}
+	cerr := &chaincodeError{}
+	err := json.Unmarshal(response.Payload, cerr)
+	if err != nil {
+		f.t.Fatalf("%v: error payload %q: %v", args, response.Payload, err)
+	}
+	if cerr.Code != code {
+		f.t.Fatalf("%v failed with %s (%s), want %s", args, cerr.Code, cerr.Message, code)
+	}
+}
+
+// record returns the stored record of a column for the test setting, nil if there is none.
+func (f *fixture) record(c_id string) *marble {
+	f.t.Helper()
+	marbleAsBytes := f.ledger.State()[c_id+"all"+s_date+e_date+"hippa"]
+	if marbleAsBytes == nil {
+		return nil
+	}
+	record := &marble{}
+	err := json.Unmarshal(marbleAsBytes, record)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return record
+}
+
+// indexed tells whether the patient index has the entry of a patient and column.
+func (f *fixture) indexed(p_id string, c_id string) bool {
+	key, _ := f.ledger.NewTx(nil, nil).CreateCompositeKey(patientIndex, []string{p_id, "all", s_date, e_date, "hippa", c_id})
+	return f.ledger.State()[key] != nil
+}
+
+func (f *fixture) grant(p_id string, columns string) {
+	f.t.Helper()
+	f.ok(f.custodian, "updateConsent", p_id, "g", "all", s_date, e_date, columns, "hippa")
+}
+
+func (f *fixture) revoke(p_id string, columns string) {
+	f.t.Helper()
+	f.ok(f.custodian, "updateConsent", p_id, "r", "all", s_date, e_date, columns, "hippa")
+}
+
+func (f *fixture) trace(payload []byte) *accessTrace {
+	f.t.Helper()
+	trace := &accessTrace{}
+	err := json.Unmarshal(payload, trace)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return trace
+}
+
+func writes(tx *memstub.Tx, key string) bool {
+	for _, written := range tx.WriteSet() {
+		if written == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGrantAddsPatientToEachColumn(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102")
+	f.grant("3", "101")
+	for c_id, want := range map[string][]string{"101": {"2", "3"}, "102": {"2"}} {
+		record := f.record(c_id)
+		if record == nil {
+			t.Fatalf("no record for column %s", c_id)
+		}
+		if len(record.UserIDs) != len(want) {
+			t.Errorf("column %s has patients %v, want %v", c_id, record.UserIDs, want)
+		}
+		for _, p_id := range want {
+			if record.UserIDs[p_id] != stateActive {
+				t.Errorf("column %s: patient %s has state %d, want active", c_id, p_id, record.UserIDs[p_id])
+			}
+			if !f.indexed(p_id, c_id) {
+				t.Errorf("no index entry for patient %s on column %s", p_id, c_id)
+			}
+		}
+	}
+}
+
+func TestGrantReturnsReceipt(t *testing.T) {
+	f := newFixture(t)
+	payload := f.ok(f.custodian, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	verification := f.ok(f.custodian, "verifyConsentReceipt", string(payload))
+	var result struct {
+		Match bool `json:"match"`
+	}
+	json.Unmarshal(verification, &result)
+	if !result.Match {
+		t.Errorf("receipt %s does not verify", payload)
+	}
+}
+
+func TestDuplicateGrantDoesNotRewriteRecord(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	before := string(f.ledger.State()["101all"+s_date+e_date+"hippa"])
+	response, tx := f.invoke(f.custodian, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if writes(tx, "101all"+s_date+e_date+"hippa") {
+		t.Errorf("duplicate grant rewrote the record")
+	}
+	if after := string(f.ledger.State()["101all"+s_date+e_date+"hippa"]); after != before {
+		t.Errorf("record changed from %s to %s", before, after)
+	}
+	// nor issues another receipt
+	if len(response.Payload) != 0 || len(tx.WriteSet()) != 0 {
+		t.Errorf("duplicate grant returned %s and wrote %v", response.Payload, tx.WriteSet())
+	}
+}
+
+func TestRevokeLastPatientDeletesRecord(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	response, tx := f.invoke(f.custodian, "updateConsent", "2", "r", "all", s_date, e_date, "101", "hippa")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if !writes(tx, "101all"+s_date+e_date+"hippa") {
+		t.Errorf("revoke did not delete the record")
+	}
+	if f.record("101") != nil {
+		t.Errorf("record of the last patient still exists")
+	}
+	if f.indexed("2", "101") {
+		t.Errorf("index entry of the revoked consent still exists")
+	}
+}
+
+func TestRevokeKeepsOtherPatients(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.grant("3", "101")
+	f.revoke("2", "101")
+	record := f.record("101")
+	if record == nil || len(record.UserIDs) != 1 || record.UserIDs["3"] != stateActive {
+		t.Fatalf("record after revoke = %+v, want only patient 3", record)
+	}
+	if !f.indexed("3", "101") || f.indexed("2", "101") {
+		t.Errorf("index entries do not match the record")
+	}
+}
+
+func TestRevokeWithoutConsentWritesNothing(t *testing.T) {
+	f := newFixture(t)
+	response, tx := f.invoke(f.custodian, "updateConsent", "2", "r", "all", s_date, e_date, "101", "hippa")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if len(tx.WriteSet()) != 0 {
+		t.Errorf("revoking a missing consent wrote %v", tx.WriteSet())
+	}
+}
+
+func TestUpdateConsentRejectsBadArguments(t *testing.T) {
+	f := newFixture(t)
+	f.fails(errInvalidArgument, f.custodian, "updateConsent", "2", "x", "all", s_date, e_date, "101", "hippa")
+	f.fails(errInvalidArgument, f.custodian, "updateConsent", "2", "g", "all", "2015-01-01", e_date, "101", "hippa")
+	f.fails(errInvalidArgument, f.custodian, "updateConsent", "2", "g", "all", e_date, s_date, "101", "hippa")
+	f.fails(errNotFound, f.custodian, "updateConsent", "2", "g", "all", s_date, e_date, "101", "nowatchdog")
+	f.fails(errUnauthorized, f.consumer, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+}
+
+func TestNamedArguments(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.custodian, "updateConsent", `{"patient_id":"2","action":"g","role_id":"all","start_date":"20150101",
+		"end_date":"20160101","column_ids":["101","102"],"watchdog_id":"hippa"}`)
+	if !f.indexed("2", "101") || !f.indexed("2", "102") {
+		t.Errorf("named grant not applied")
+	}
+	for _, args := range []string{
+		// a list item would be split into two columns
+		`{"patient_id":"2","action":"g","role_id":"all","start_date":"20150101","column_ids":["101,103"],"watchdog_id":"hippa"}`,
+		// text must be a JSON string
+		`{"patient_id":2,"action":"g","role_id":"all","start_date":"20150101","column_ids":["103"],"watchdog_id":"hippa"}`,
+		`{"patient_id":"2","action":"g","role_id":"all","start_date":20150101,"column_ids":["103"],"watchdog_id":"hippa"}`,
+		`{"patient_id":"2","action":"g","role_id":"all","start_date":"20150101","column_ids":[103],"watchdog_id":"hippa"}`,
+		`{"patient_id":"2","action":"g","role_id":"all","start_date":"20150101","column_ids":["103"],"watchdog":"hippa"}`,
+	} {
+		f.fails(errInvalidArgument, f.custodian, "updateConsent", args)
+	}
+	if f.record("103") != nil {
+		t.Errorf("an invalid grant was applied")
+	}
+	// a number may be given as one
+	f.ok(f.custodian, "sweepExpired", `{"mode":"mark","limit":10}`)
+}
+
+func TestTransientArguments(t *testing.T) {
+	f := newFixture(t)
+	transient := map[string][]byte{"patient_id": []byte("3"), "column_ids": []byte(`["101","102"]`)}
+	response, tx := f.ledger.Invoke(f.cc, f.custodian, transient, "updateConsent", "", "g", "all", s_date, e_date, "", "hippa")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	for _, arg := range tx.GetStringArgs() {
+		if arg == "3" {
+			t.Errorf("the patient id is among the recorded arguments %v", tx.GetStringArgs())
+		}
+	}
+	if !f.indexed("3", "101") || !f.indexed("3", "102") {
+		t.Errorf("transient grant not applied")
+	}
+	for _, transient := range []map[string][]byte{
+		{"patient_id": []byte("3"), "column_ids": []byte(`["103,104"]`)},
+		{"patient_id": []byte("3"), "column_ids": []byte(`[103]`)},
+	} {
+		response, _ = f.ledger.Invoke(f.cc, f.custodian, transient, "updateConsent", "", "g", "all", s_date, e_date, "", "hippa")
+		if response.Status == shim.OK {
+			t.Errorf("transient %s accepted", transient["column_ids"])
+		}
+	}
+	// an argument may not be given both ways
+	response, _ = f.ledger.Invoke(f.cc, f.custodian, map[string][]byte{"patient_id": []byte("3")}, "updateConsent", "3", "g", "all", s_date, e_date, "103", "hippa")
+	if response.Status == shim.OK {
+		t.Errorf("patient id given twice accepted")
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	f := newFixture(t)
+	report := func(payload []byte) initializeReport {
+		r := initializeReport{}
+		json.Unmarshal(payload, &r)
+		return r
+	}
+	r := report(f.ok(f.custodian, "initialize", "101", "replace", "all", s_date, e_date, "1,2,3", "hippa"))
+	if r.Added != 3 || r.Removed != 0 || r.Total != 3 {
+		t.Errorf("replace into an empty column: %+v", r)
+	}
+	r = report(f.ok(f.custodian, "initialize", "101", "replace", "all", s_date, e_date, "3,4", "hippa"))
+	if r.Added != 1 || r.Removed != 2 || r.Total != 2 {
+		t.Errorf("replace: %+v", r)
+	}
+	r = report(f.ok(f.custodian, "initialize", "101", "merge", "all", s_date, e_date, "4,5", "hippa"))
+	if r.Added != 1 || r.Removed != 0 || r.Total != 3 {
+		t.Errorf("merge: %+v", r)
+	}
+	if record := f.record("101"); record == nil || len(record.UserIDs) != 3 {
+		t.Fatalf("record after merge = %+v", record)
+	}
+	if f.indexed("1", "101") || !f.indexed("5", "101") {
+		t.Errorf("index entries do not follow initialize")
+	}
+	// removing everyone deletes the setting
+	r = report(f.ok(f.custodian, "initialize", "101", "remove", "all", s_date, e_date, "3,4,5", "hippa"))
+	if r.Removed != 3 || r.Total != 0 {
+		t.Errorf("remove: %+v", r)
+	}
+	if f.record("101") != nil {
+		t.Errorf("record of an emptied column still exists")
+	}
+	f.fails(errInvalidArgument, f.custodian, "initialize", "101", "swap", "all", s_date, e_date, "1", "hippa")
+	f.fails(errUnauthorized, f.patient, "initialize", "101", "merge", "all", s_date, e_date, "2", "hippa")
+}
+
+func TestUpdateRole(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	if f.ledger.State()["hippaalldc1"] == nil {
+		t.Fatalf("approval not stored")
+	}
+	// only the watchdog's own identity may approve
+	other := identity(t, "Org1MSP", "other", map[string]string{"consentio.role": "watchdog"})
+	f.fails(errUnauthorized, other, "updateRole", "hippa", "all", "dc2", "g")
+	f.fails(errUnauthorized, f.custodian, "updateRole", "hippa", "all", "dc2", "g")
+	// and only for the roles it governs
+	f.fails(errUnauthorized, f.watchdog, "updateRole", "hippa", "research", "dc1", "g")
+	f.fails(errInvalidArgument, f.watchdog, "updateRole", "hippa", "all", "dc1", "x")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "r")
+	if f.ledger.State()["hippaalldc1"] != nil {
+		t.Errorf("revoked approval still stored")
+	}
+}
+
+func TestAccessConsent(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102")
+	f.grant("3", "101")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101,102,103", "hippa", "dc1"))
+	if !trace.Granted {
+		t.Fatalf("access denied: %s", trace.Reason)
+	}
+	if trace.Columns["101"] != 2 || trace.Columns["102"] != 1 || trace.Columns["103"] != 0 {
+		t.Errorf("columns = %v", trace.Columns)
+	}
+	if trace.Certificate == nil || trace.Certificate.ConsumerID != "dc1" {
+		t.Errorf("no access certificate issued: %+v", trace.Certificate)
+	}
+}
+
+func TestAccessConsentDenied(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	// without the watchdog's approval
+	f.fails(errUnauthorized, f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	// consent not found: nobody consented to the columns
+	f.fails(errNotFound, f.consumer, "accessConsent", "all", s_date, e_date, "102,103", "hippa", "dc1")
+	// nor in another window
+	f.fails(errNotFound, f.consumer, "accessConsent", "all", s_date, "20151231", "101", "hippa", "dc1")
+	// a revoke takes effect immediately
+	f.revoke("2", "101")
+	f.fails(errNotFound, f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+	// patients cannot request access
+	f.fails(errUnauthorized, f.patient, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+}
+
+func TestAccessConsentBoundToCallerConsumer(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc2", "g")
+	// the consumer is taken from the certificate when left out
+	trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", ""))
+	if !trace.Granted || trace.ConsumerID != "dc1" {
+		t.Errorf("decision = %+v, want access for dc1", trace)
+	}
+	// and cannot be another approved consumer
+	f.fails(errUnauthorized, f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc2")
+	f.fails(errUnauthorized, f.consumer, "explainAccess", "all", s_date, e_date, "101", "hippa", "dc2")
+	unnamed := identity(t, "Org3MSP", "unnamed", map[string]string{"consentio.role": "consumer"})
+	f.fails(errUnauthorized, unnamed, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+	// custodians diagnose requests on behalf of a named consumer, but do not make them
+	f.fails(errUnauthorized, f.custodian, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+	f.fails(errInvalidArgument, f.custodian, "explainAccess", "all", s_date, e_date, "101", "hippa", "")
+	if trace := f.trace(f.ok(f.custodian, "explainAccess", "all", s_date, e_date, "101", "hippa", "dc2")); !trace.Granted {
+		t.Errorf("explained decision for dc2 = %+v", trace)
+	}
+}
+
+func TestVerifyAccessCertificateChecksHolder(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1"))
+	certificateJSONasBytes, err := json.Marshal(trace.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := string(certificateJSONasBytes)
+	holder := trace.Certificate.Holder
+	check := &certificateCheck{}
+	json.Unmarshal(f.ok(f.custodian, "verifyAccessCertificate", certificate, holder), check)
+	if !check.Match || !check.Current {
+		t.Errorf("check = %+v", check)
+	}
+	json.Unmarshal(f.ok(f.consumer, "verifyAccessCertificate", certificate, ""), check)
+	if !check.Match {
+		t.Errorf("holder's own check = %+v", check)
+	}
+	// shown by anyone else it is worthless
+	other := identity(t, "Org3MSP", "dc2", map[string]string{"consentio.role": "consumer", "consentio.consumer_id": "dc2"})
+	f.fails(errUnauthorized, other, "verifyAccessCertificate", certificate, "")
+	f.fails(errUnauthorized, other, "verifyAccessCertificate", certificate, holder)
+	f.fails(errUnauthorized, f.custodian, "verifyAccessCertificate", certificate, "someone else")
+	f.fails(errInvalidArgument, f.custodian, "verifyAccessCertificate", certificate, "")
+}
+
+func TestExplainAccessListsEveryFailure(t *testing.T) {
+	f := newFixture(t)
+	trace := f.trace(f.ok(f.custodian, "explainAccess", "all", s_date, e_date, "101", "hippa", "dc1"))
+	if trace.Granted {
+		t.Fatalf("access granted without approval or consent")
+	}
+	failed := map[string]bool{}
+	for _, step := range trace.Steps {
+		if !step.Passed {
+			failed[step.Step] = true
+		}
+	}
+	if !failed["role_approved"] || !failed["column_consent"] || failed["watchdog_registered"] {
+		t.Errorf("failed steps = %v", failed)
+	}
+	if trace.Code != errUnauthorized {
+		t.Errorf("reason code = %s, want the first failure", trace.Code)
+	}
+}
+
+// governance returns the stored governance record.
+func (f *fixture) governance() *governance {
+	f.t.Helper()
+	govKey, _ := f.ledger.NewTx(nil, nil).CreateCompositeKey("governance", []string{})
+	gov := &governance{}
+	err := json.Unmarshal(f.ledger.State()[govKey], gov)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return gov
+}
+
+func TestConsentProof(t *testing.T) {
+	f := newFixture(t)
+	for _, p_id := range []string{"2", "3", "4", "5", "6"} {
+		f.grant(p_id, "101")
+	}
+	proof := &consentProof{}
+	err := json.Unmarshal(f.ok(f.custodian, "getConsentProof", "4", "all", s_date, e_date, "101", "hippa"), proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.Key != "101all"+s_date+e_date+"hippa" || proof.Size != 5 || !proof.Verify() {
+		t.Errorf("proof = %+v, want a valid proof over five patients", proof)
+	}
+	if proof.Root != f.record("101").MerkleRoot {
+		t.Errorf("proof root %s is not the stored merkle_root %s", proof.Root, f.record("101").MerkleRoot)
+	}
+	// a tampered path no longer leads to the root
+	proof.Path[0] = proof.Path[len(proof.Path)-1] + "00"
+	if proof.Verify() {
+		t.Errorf("tampered proof verified")
+	}
+	f.revoke("4", "101")
+	f.fails(errNotFound, f.custodian, "getConsentProof", "4", "all", s_date, e_date, "101", "hippa")
+	f.fails(errNotFound, f.custodian, "getConsentProof", "2", "all", s_date, e_date, "102", "hippa")
+	f.fails(errUnauthorized, f.consumer, "getConsentProof", "2", "all", s_date, e_date, "101", "hippa")
+}
+
+func TestUpgradeMergesGovernance(t *testing.T) {
+	f := newFixture(t)
+	response := f.ledger.Init(f.cc, f.admin, `{"require_pseudonyms":true,"secret_collection":"consentioSecrets"}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	// MSP ids replace only the governors
+	response = f.ledger.Init(f.cc, f.admin, "Org1MSP", "Org4MSP")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	gov := f.governance()
+	if len(gov.MSPIDs) != 2 || !gov.RequirePseudonyms || gov.SecretCollection != "consentioSecrets" {
+		t.Errorf("governance after upgrade = %+v", gov)
+	}
+}
+
+func TestUpgradeKeepsStorageOnceConsentExists(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	for _, arg := range []string{`{"require_pseudonyms":true}`, `{"consent_collection":"consentioConsents"}`, `{"hash_patient_ids":true,"secret_collection":"consentioSecrets"}`} {
+		response := f.ledger.Init(f.cc, f.admin, arg)
+		cerr := &chaincodeError{}
+		json.Unmarshal(response.Payload, cerr)
+		if response.Status == shim.OK || cerr.Code != errConflict {
+			t.Errorf("upgrade with %s: status %d %s", arg, response.Status, response.Message)
+		}
+	}
+	response := f.ledger.Init(f.cc, f.admin, `{"msp_ids":["Org1MSP","Org4MSP"]}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if gov := f.governance(); len(gov.MSPIDs) != 2 || gov.RequirePseudonyms || gov.ConsentCollection != "" || gov.HashPatientIDs {
+		t.Errorf("governance after upgrade = %+v", gov)
+	}
+}
+
+func TestPatientUpdatesOnlyOwnConsent(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.patient, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	if !f.indexed("2", "101") {
+		t.Errorf("patient could not grant its own consent")
+	}
+	f.fails(errUnauthorized, f.patient, "updateConsent", "3", "g", "all", s_date, e_date, "101", "hippa")
+	if record := f.record("101"); len(record.UserIDs) != 1 {
+		t.Errorf("patients after a refused update = %v", record.UserIDs)
+	}
+}
+
+func TestRolesBoundToIssuingMSP(t *testing.T) {
+	f := newFixture(t)
+	// Org3MSP does not govern the channel, so the custodian and patient roles it issues count for nothing
+	foreign := identity(t, "Org3MSP", "custodian", map[string]string{"consentio.role": "custodian"})
+	f.fails(errUnauthorized, foreign, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	f.fails(errUnauthorized, foreign, "getPatientConsents", "2")
+	patient := identity(t, "Org3MSP", "patient2", map[string]string{"consentio.role": "patient", "consentio.patient_id": "2"})
+	f.fails(errUnauthorized, patient, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	f.grant("2", "101")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	// consumers come from any MSP until the governance names theirs
+	f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+	response := f.ledger.Init(f.cc, f.admin, `{"consumer_msp_ids":["Org4MSP"]}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	f.fails(errUnauthorized, f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+	member := identity(t, "Org4MSP", "dc1", map[string]string{"consentio.role": "consumer", "consentio.consumer_id": "dc1"})
+	f.ok(member, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+}
+
+func TestConsentHistoryOfOwnConsentOnly(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.grant("3", "101")
+	history := []historyEntry{}
+	err := json.Unmarshal(f.ok(f.patient, "getConsentHistory", "2", "all", s_date, e_date, "101", "hippa"), &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("history of patient 2 = %+v", history)
+	}
+	f.fails(errUnauthorized, f.patient, "getConsentHistory", "3", "all", s_date, e_date, "101", "hippa")
+}
+
+func (f *fixture) consents(id *memstub.Identity, args ...string) *patientConsents {
+	f.t.Helper()
+	result := &patientConsents{}
+	err := json.Unmarshal(f.ok(id, append([]string{"getPatientConsents"}, args...)...), result)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return result
+}
+
+func TestGetPatientConsents(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "102,101")
+	f.ok(f.custodian, "updateConsent", "2", "g", "all", s_date, "20170101", "103", "hippa")
+	f.grant("3", "104")
+	// the patient lists its own consents, one entry per setting
+	result := f.consents(f.patient)
+	if result.PatientID != "2" || len(result.Consents) != 2 {
+		t.Fatalf("consents = %+v, want two settings of patient 2", result)
+	}
+	want := []patientConsent{{"all", "hippa", s_date, e_date, []string{"101", "102"}, "active"},
+		{"all", "hippa", s_date, "20170101", []string{"103"}, "active"}}
+	for i, consent := range result.Consents {
+		if !reflect.DeepEqual(*consent, want[i]) {
+			t.Errorf("consent %d = %+v, want %+v", i, *consent, want[i])
+		}
+	}
+	f.fails(errUnauthorized, f.patient, "getPatientConsents", "3")
+	// custodians name the patient
+	f.fails(errInvalidArgument, f.custodian, "getPatientConsents", "")
+	if result := f.consents(f.custodian, "3"); len(result.Consents) != 1 || result.Consents[0].ColumnIDs[0] != "104" {
+		t.Errorf("consents of patient 3 = %+v", result)
+	}
+	// revoked consents are no longer listed
+	f.revoke("2", "101,102")
+	if result := f.consents(f.custodian, "2"); len(result.Consents) != 1 || result.Consents[0].EndDate != "20170101" {
+		t.Errorf("consents after revoke = %+v", result)
+	}
+	if result := f.consents(f.custodian, "9"); result.Consents == nil || len(result.Consents) != 0 {
+		t.Errorf("consents of a patient without any = %+v, want an empty list", result)
+	}
+}
+
+func (f *fixture) withdraw(id *memstub.Identity, args ...string) *withdrawalReceipt {
+	f.t.Helper()
+	response, tx := f.invoke(id, append([]string{"withdrawAllConsent"}, args...)...)
+	if response.Status != shim.OK {
+		f.t.Fatalf("withdrawAllConsent %v: %s", args, response.Message)
+	}
+	if event := tx.Event(); event == nil || event.Name != "consentWithdrawn" || string(event.Payload) != string(response.Payload) {
+		f.t.Errorf("event = %+v, want the receipt as consentWithdrawn", event)
+	}
+	receipt := &withdrawalReceipt{}
+	err := json.Unmarshal(response.Payload, receipt)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return receipt
+}
+
+func TestWithdrawAllConsent(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102")
+	f.ok(f.custodian, "updateConsent", "2", "g", "all", s_date, "20170101", "103", "hippa")
+	f.grant("3", "101")
+	f.fails(errUnauthorized, f.patient, "withdrawAllConsent", "3", "10")
+	f.fails(errInvalidArgument, f.custodian, "withdrawAllConsent", "2", "0")
+	// withdrawn even though the watchdog has since been removed
+	f.ok(f.admin, "removeWatchdog", "hippa")
+	// each index entry is one column, so a limit of two stops after the first setting
+	receipt := f.withdraw(f.patient, "", "2")
+	if receipt.PatientID != "2" || receipt.Complete || len(receipt.Withdrawn) != 1 || len(receipt.Withdrawn[0].ColumnIDs) != 2 {
+		t.Fatalf("first receipt = %+v, want the two columns of the first setting", receipt)
+	}
+	receipt = f.withdraw(f.patient, "", "2")
+	if !receipt.Complete || len(receipt.Withdrawn) != 1 || receipt.Withdrawn[0].EndDate != "20170101" {
+		t.Fatalf("second receipt = %+v, want the rest", receipt)
+	}
+	if record := f.record("101"); record == nil || len(record.UserIDs) != 1 || record.UserIDs["3"] != stateActive {
+		t.Errorf("record 101 = %+v, want only patient 3", record)
+	}
+	if f.record("102") != nil || f.indexed("2", "101") || f.indexed("2", "102") {
+		t.Errorf("withdrawn consents still stored or indexed")
+	}
+	if result := f.consents(f.custodian, "2"); len(result.Consents) != 0 {
+		t.Errorf("consents after withdrawal = %+v", result)
+	}
+	if receipt := f.withdraw(f.custodian, "2"); !receipt.Complete || len(receipt.Withdrawn) != 0 {
+		t.Errorf("receipt without consents = %+v", receipt)
+	}
+}
+
+func TestPrivateConsentCollection(t *testing.T) {
+	f := newFixture(t)
+	response := f.ledger.Init(f.cc, f.admin, `{"consent_collection":"consentioConsents"}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	f.grant("2", "101")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	key := "101all" + s_date + e_date + "hippa"
+	private := f.ledger.PrivateState("consentioConsents")
+	if private[key] == nil || f.ledger.State()[key] != nil {
+		t.Fatalf("record is not kept only in the collection")
+	}
+	indexKey, _ := f.ledger.NewTx(nil, nil).CreateCompositeKey(patientIndex, []string{"2", "all", s_date, e_date, "hippa", "101"})
+	if private[indexKey] == nil || f.ledger.State()[indexKey] != nil {
+		t.Errorf("index entry is not kept only in the collection")
+	}
+	// public state holds the hash any organisation can check a record shown to it against
+	stored := string(private[key])
+	check := map[string]bool{}
+	json.Unmarshal(f.ok(f.consumer, "verifyConsentRecord", key, stored), &check)
+	if !check["match"] {
+		t.Errorf("stored record does not match its hash")
+	}
+	json.Unmarshal(f.ok(f.consumer, "verifyConsentRecord", key, stored+" "), &check)
+	if check["match"] {
+		t.Errorf("altered record matches the hash")
+	}
+	f.fails(errNotFound, f.consumer, "verifyConsentRecord", "102all"+s_date+e_date+"hippa", "{}")
+	// access and the patient's listing read the private records
+	if trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")); !trace.Granted {
+		t.Errorf("access denied on a private consent: %s", trace.Reason)
+	}
+	if result := f.consents(f.custodian, "2"); len(result.Consents) != 1 {
+		t.Errorf("consents = %+v", result)
+	}
+	// Fabric keeps no history of private data
+	f.fails(errInvalidArgument, f.custodian, "getConsentHistory", "2", "all", s_date, e_date, "101", "hippa")
+	// a revoke removes the hash with the record
+	f.revoke("2", "101")
+	if f.ledger.PrivateState("consentioConsents")[key] != nil {
+		t.Errorf("revoked record still stored")
+	}
+	f.fails(errNotFound, f.consumer, "verifyConsentRecord", key, stored)
+}
+
+// initWithSalt calls Init with the salt in the transient data.
+func (f *fixture) initWithSalt(salt string, arg string) pb.Response {
+	tx := f.ledger.NewTx(f.admin, map[string][]byte{"salt": []byte(salt)}, "init", arg)
+	response := f.cc.Init(tx)
+	if response.Status == shim.OK {
+		f.ledger.Commit(tx)
+	}
+	return response
+}
+
+func TestHashedPatientIDs(t *testing.T) {
+	f := newFixture(t)
+	if response := f.initWithSalt("s4lt", `{"hash_patient_ids":true}`); response.Status == shim.OK {
+		t.Errorf("hash_patient_ids accepted without a secret_collection")
+	}
+	response := f.initWithSalt("s4lt", `{"hash_patient_ids":true,"secret_collection":"consentioSecrets"}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if string(f.ledger.PrivateState("consentioSecrets")["patient_salt"]) != "s4lt" {
+		t.Errorf("salt not kept in the secret collection")
+	}
+	f.grant("2", "101")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	hashed := keyedHash([]byte("s4lt"), "2")
+	if record := f.record("101"); record == nil || record.UserIDs[hashed] != stateActive || record.UserIDs["2"] != 0 {
+		t.Errorf("record = %+v, want only the hashed id", record)
+	}
+	if !f.indexed(hashed, "101") || f.indexed("2", "101") {
+		t.Errorf("patient index not keyed by the hashed id")
+	}
+	// callers keep using the plain id
+	if result := f.consents(f.patient); len(result.Consents) != 1 {
+		t.Errorf("consents = %+v", result)
+	}
+	trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1"))
+	if len(trace.Patients["101"]) != 1 || trace.Patients["101"][0] != hashed {
+		t.Errorf("granted patients = %v, want the hashed id", trace.Patients)
+	}
+	// an upgrade may leave the salt out, but not change it
+	if response := f.ledger.Init(f.cc, f.admin, "Org1MSP"); response.Status != shim.OK {
+		t.Errorf("upgrade without the salt: %s", response.Message)
+	}
+	if response := f.initWithSalt("other", "Org1MSP"); response.Status == shim.OK {
+		t.Errorf("salt changed on upgrade")
+	}
+	f.revoke("2", "101")
+	if result := f.consents(f.custodian, "2"); len(result.Consents) != 0 {
+		t.Errorf("consents after revoke = %+v", result)
+	}
+}
+
+func TestSetConsentState(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	f.ok(f.custodian, "setConsentState", "2", "all", s_date, e_date, "101", "hippa", "suspended")
+	if record := f.record("101"); record.UserIDs["2"] != stateSuspended {
+		t.Fatalf("record = %+v, want patient 2 suspended", record)
+	}
+	// only active consents give access
+	trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101,102", "hippa", "dc1"))
+	if trace.Columns["101"] != 0 || trace.Columns["102"] != 1 {
+		t.Errorf("columns = %v, want the suspended one left out", trace.Columns)
+	}
+	// neither the patient nor a new grant lifts the suspension
+	f.fails(errUnauthorized, f.patient, "setConsentState", "", "all", s_date, e_date, "101", "hippa", "active")
+	f.grant("2", "101")
+	if f.record("101").UserIDs["2"] != stateSuspended {
+		t.Errorf("a grant lifted the suspension")
+	}
+	result := f.consents(f.patient)
+	if len(result.Consents) != 2 || result.Consents[0].State != "suspended" || result.Consents[1].State != "active" {
+		t.Errorf("consents = %+v, want the columns grouped by state", result)
+	}
+	f.ok(f.custodian, "setConsentState", "2", "all", s_date, e_date, "101", "hippa", "active")
+	// the patient withdraws, keeping the record; only a new grant undoes that
+	f.ok(f.patient, "setConsentState", "", "all", s_date, e_date, "101,102", "hippa", "withdrawn")
+	if f.record("101").UserIDs["2"] != stateWithdrawn || f.record("102").UserIDs["2"] != stateWithdrawn {
+		t.Errorf("consents not withdrawn")
+	}
+	f.fails(errConflict, f.custodian, "setConsentState", "2", "all", s_date, e_date, "101", "hippa", "active")
+	f.fails(errInvalidArgument, f.custodian, "setConsentState", "2", "all", s_date, e_date, "101", "hippa", "paused")
+	f.fails(errNotFound, f.custodian, "setConsentState", "2", "all", s_date, e_date, "103", "hippa", "suspended")
+	f.grant("2", "101")
+	if f.record("101").UserIDs["2"] != stateActive {
+		t.Errorf("a new grant did not reactivate the withdrawn consent")
+	}
+}
+
+func TestBulkUpdateConsentAtomic(t *testing.T) {
+	f := newFixture(t)
+	grant := func(p_id string, c_id string, w_id string) *consentOp {
+		return &consentOp{PatientID: p_id, Action: "g", RoleID: "all", StartDate: s_date, EndDate: e_date, ColumnIDs: []string{c_id}, WatchdogID: w_id}
+	}
+	ops := []*consentOp{grant("2", "101", "hippa"), grant("3", "101", "nowatchdog"), grant("4", "102", "hippa")}
+	opsAsBytes, _ := json.Marshal(ops)
+	// atomic is the default: one invalid operation and nothing is written
+	response, tx := f.invoke(f.custodian, "bulkUpdateConsent", string(opsAsBytes))
+	if response.Status == shim.OK || len(tx.WriteSet()) != 0 {
+		t.Fatalf("bulk update with an invalid operation succeeded or wrote %v", tx.WriteSet())
+	}
+	failure := &struct {
+		Code    string     `json:"code"`
+		Details bulkReport `json:"details"`
+	}{}
+	err := json.Unmarshal(response.Payload, failure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := failure.Details.Results
+	if failure.Code != errInvalidArgument || failure.Details.Invalid != 1 || len(results) != 3 ||
+		results[0].Status != "skipped" || results[1].Status != "invalid" || results[1].Code != errNotFound || results[2].Status != "skipped" {
+		t.Errorf("failure = %+v", failure)
+	}
+	if f.record("101") != nil || f.record("102") != nil {
+		t.Errorf("atomic bulk update applied part of the operations")
+	}
+	// with every operation valid all are applied, and repeats report unchanged
+	ops[1].WatchdogID = "hippa"
+	ops = append(ops, grant("2", "101", "hippa"))
+	opsAsBytes, _ = json.Marshal(ops)
+	report := &bulkReport{}
+	err = json.Unmarshal(f.ok(f.custodian, "bulkUpdateConsent", string(opsAsBytes), "atomic"), report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Mode != "atomic" || report.Applied != 3 || report.Unchanged != 1 || report.Results[3].Status != "unchanged" {
+		t.Errorf("report = %+v", report)
+	}
+	if record := f.record("101"); record == nil || len(record.UserIDs) != 2 || f.record("102") == nil {
+		t.Errorf("operations not applied")
+	}
+	f.fails(errInvalidArgument, f.custodian, "bulkUpdateConsent", string(opsAsBytes), "some")
+	f.fails(errInvalidArgument, f.custodian, "bulkUpdateConsent", "{}", "atomic")
+}
+
+func TestExplainAccessWithholdsPatients(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	// without the watchdog's approval the request is denied
+	trace := f.trace(f.ok(f.custodian, "explainAccess", "all", s_date, e_date, "101", "hippa", "dc1"))
+	if trace.Granted || trace.Patients != nil {
+		t.Errorf("denied trace = %+v", trace)
+	}
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	trace = f.trace(f.ok(f.custodian, "explainAccess", "all", s_date, e_date, "101", "hippa", "dc1"))
+	if !trace.Granted || len(trace.Patients["101"]) != 1 {
+		t.Errorf("granted trace for the custodian = %+v", trace)
+	}
+	trace = f.trace(f.ok(f.consumer, "explainAccess", "all", s_date, e_date, "101", "hippa", "dc1"))
+	if !trace.Granted || trace.Patients != nil {
+		t.Errorf("granted trace for the consumer = %+v", trace)
+	}
+}
+
+// signer is a patient's Ed25519 key pair.
+type signer struct {
+	pem  string
+	priv ed25519.PrivateKey
+}
+
+func newSigner(t *testing.T) *signer {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), priv}
+}
+
+func (s *signer) sign(t *testing.T, message interface{}) string {
+	messageAsBytes, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.priv, messageAsBytes))
+}
+
+func TestFirstPatientKeyRegisteredByPatient(t *testing.T) {
+	f := newFixture(t)
+	first, second := newSigner(t), newSigner(t)
+	f.fails(errUnauthorized, f.custodian, "registerPatientKey", "2", first.pem)
+	f.ok(f.patient, "registerPatientKey", "2", first.pem)
+	// the current key signs its replacement, which the custodian may submit
+	f.fails(errConflict, f.custodian, "registerPatientKey", "2", second.pem)
+	signature := first.sign(t, map[string]string{"patient_id": "2", "public_key": second.pem})
+	f.ok(f.custodian, "registerPatientKey", "2", second.pem, signature)
+}
+
+func TestNonceUsedOncePerTransaction(t *testing.T) {
+	f := newFixture(t)
+	key := newSigner(t)
+	f.ok(f.patient, "registerPatientKey", "2", key.pem)
+	var ops []*consentOp
+	for _, c_id := range []string{"101", "102"} {
+		op := &consentOp{"2", "g", "all", s_date, e_date, []string{c_id}, "hippa", "", "n1"}
+		op.Signature = key.sign(t, signedOperation{op.PatientID, op.Action, op.RoleID, op.StartDate, op.EndDate, op.ColumnIDs, op.WatchdogID, op.Nonce})
+		ops = append(ops, op)
+	}
+	opsAsBytes, _ := json.Marshal(ops)
+	report := &bulkReport{}
+	err := json.Unmarshal(f.ok(f.custodian, "bulkUpdateConsent", string(opsAsBytes), "per-item"), report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Results[0].Status != "applied" || report.Results[1].Code != errConflict {
+		t.Errorf("results = %+v", report.Results)
+	}
+	// nor can it be used again in a later transaction
+	f.fails(errConflict, f.custodian, "updateConsent", "2", "g", "all", s_date, e_date, "102", "hippa", ops[1].Signature, "n1")
+}
+
+func TestAccessConsentAfterWindowExpired(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g")
+	// the last day of the window still gives access, the next does not, swept or not
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 1, 23, 0, 0, 0, time.UTC) }
+	f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC) }
+	f.fails(errExpired, f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa", "dc1")
+}
+
+func (f *fixture) sweep(args ...string) *sweepReport {
+	f.t.Helper()
+	report := &sweepReport{}
+	err := json.Unmarshal(f.ok(f.custodian, append([]string{"sweepExpired"}, args...)...), report)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return report
+}
+
+func TestSweepExpiredMarksLapsedConsents(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.ok(f.custodian, "updateConsent", "2", "g", "all", s_date, "20170101", "101", "hippa")
+	// a column id that looks like a key of the expiry index is a column like any other
+	f.ok(f.custodian, "updateConsent", "3", "g", "all", s_date, "20170101", "expiry_20000101_x", "hippa")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g", e_date)
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc2", "g", "20170101")
+	// nothing has lapsed yet, including on the last day
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC) }
+	if r := f.sweep(); r.Consents != 0 || r.Roles != 0 || !r.Complete {
+		t.Errorf("sweep on the last day = %+v", r)
+	}
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 2, 12, 0, 0, 0, time.UTC) }
+	if r := f.sweep(); r.Consents != 1 || r.Roles != 1 || !r.Complete {
+		t.Errorf("sweep = %+v, want one consent and one role", r)
+	}
+	if record := f.record("101"); record == nil || record.UserIDs["2"] != stateExpired {
+		t.Errorf("lapsed record = %+v, want patient 2 expired", record)
+	}
+	if !f.indexed("2", "101") {
+		t.Errorf("marking removed the index entry")
+	}
+	if f.ledger.State()["hippaalldc1"] != nil || f.ledger.State()["hippaalldc2"] == nil {
+		t.Errorf("sweep did not delete only the lapsed approval")
+	}
+	for _, unq_id := range []string{"101all" + s_date + "20170101hippa", "expiry_20000101_xall" + s_date + "20170101hippa"} {
+		record := &marble{}
+		json.Unmarshal(f.ledger.State()[unq_id], record)
+		if len(record.UserIDs) != 1 {
+			t.Errorf("record %s = %+v, want it untouched", unq_id, record)
+		}
+		for _, state := range record.UserIDs {
+			if state != stateActive {
+				t.Errorf("record %s = %+v, want it untouched", unq_id, record)
+			}
+		}
+	}
+	// the swept entries are gone
+	if r := f.sweep(); r.Consents != 0 || r.Roles != 0 {
+		t.Errorf("second sweep = %+v", r)
+	}
+}
+
+func TestSweepExpiredDeletesLapsedConsents(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102,103")
+	f.grant("3", "101")
+	f.ok(f.custodian, "updateConsent", "2", "g", "all", s_date, "20170101", "101", "hippa")
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 2, 12, 0, 0, 0, time.UTC) }
+	r := f.sweep("delete", "2")
+	if r.Consents != 2 || r.Complete || r.Cursor == "" {
+		t.Fatalf("first sweep = %+v, want two consents and a cursor", r)
+	}
+	r = f.sweep("delete", "2", r.Cursor)
+	if r.Consents != 1 || !r.Complete {
+		t.Errorf("second sweep = %+v, want the last consent", r)
+	}
+	for _, c_id := range []string{"101", "102", "103"} {
+		if f.record(c_id) != nil || f.indexed("2", c_id) {
+			t.Errorf("column %s still has its record or index entry", c_id)
+		}
+	}
+	if f.indexed("3", "101") {
+		t.Errorf("index entry of patient 3 still exists")
+	}
+	if f.ledger.State()["101all"+s_date+"20170101hippa"] == nil {
+		t.Errorf("sweep deleted a consent that has not lapsed")
+	}
+	f.fails(errInvalidArgument, f.custodian, "sweepExpired", "delete", "2", "expiry_20150101_101")
+}
+
+func TestRoleExpiryKeptWithApproval(t *testing.T) {
+	f := newFixture(t)
+	response := f.ledger.Init(f.cc, f.admin, `{"consent_collection":"consentioConsents"}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	f.fails(errInvalidArgument, f.watchdog, "updateRole", "hippa", "all", "dc1", "g", "20150531")
+	f.ok(f.watchdog, "updateRole", "hippa", "all", "dc1", "g", e_date)
+	indexKey, _ := f.ledger.NewTx(nil, nil).CreateCompositeKey(roleExpiryIndex, []string{e_date, "hippaalldc1"})
+	if f.ledger.State()[indexKey] == nil {
+		t.Fatalf("no public expiry index entry for the approval")
+	}
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 2, 12, 0, 0, 0, time.UTC) }
+	if r := f.sweep(); r.Roles != 1 {
+		t.Errorf("sweep = %+v, want one role", r)
+	}
+	if f.ledger.State()["hippaalldc1"] != nil || f.ledger.State()[indexKey] != nil {
+		t.Errorf("lapsed approval or its index entry still stored")
+	}
+}
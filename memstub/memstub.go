@@ -0,0 +1,553 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package memstub runs chaincode in process against an in-memory ledger with the
+// transaction semantics of a Fabric peer, for tests, local development and benchmarks.
+//
+// The committed world state is kept in a shim.MockStub, which provides the sorted keys
+// behind range and composite key queries, and private data collections in one MockStub
+// each. Unlike MockInvoke, a transaction is first endorsed: it reads the committed state,
+// cannot see its own writes, and records its read set and write set. Nothing is written
+// until the transaction is committed, so a failed invocation leaves no trace, and a block
+// of transactions endorsed against the same state can be validated with Fabric's MVCC
+// rule. Committed writes are kept as the history GetHistoryForKey returns. Save and Load
+// keep a ledger in a file between runs.
+package memstub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Identity is a client identity: an MSP id and a self-signed certificate carrying Fabric
+// CA attributes, as read by the chaincode's cid library.
+type Identity struct {
+	MSPID   string
+	Attrs   map[string]string
+	Creator []byte // serialized msp.SerializedIdentity
+}
+
+// NewIdentity returns an identity of the MSP with the given certificate attributes, for
+// example {"consentio.role": "patient", "consentio.patient_id": "2"}.
+func NewIdentity(mspID string, name string, attrs map[string]string) (*Identity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	attrsJSON, err := json.Marshal(&attrmgr.Attributes{Attrs: attrs})
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: name, Organization: []string{mspID}},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * 365 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: attrmgr.AttrOID, Value: attrsJSON}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: certPEM})
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{MSPID: mspID, Attrs: attrs, Creator: creator}, nil
+}
+
+// Ledger is the committed state of one channel.
+type Ledger struct {
+	// Clock gives the timestamp of each transaction; time.Now when nil.
+	Clock func() time.Time
+
+	state   *shim.MockStub
+	private map[string]*shim.MockStub
+	history map[string][]*queryresult.KeyModification
+	txCount int
+}
+
+// NewLedger returns an empty ledger.
+func NewLedger() *Ledger {
+	return &Ledger{
+		state:   shim.NewMockStub("state", nil),
+		private: make(map[string]*shim.MockStub),
+		history: make(map[string][]*queryresult.KeyModification),
+	}
+}
+
+func (l *Ledger) collection(name string) *shim.MockStub {
+	store, ok := l.private[name]
+	if !ok {
+		store = shim.NewMockStub(name, nil)
+		l.private[name] = store
+	}
+	return store
+}
+
+// State returns the committed public state. The map must not be modified.
+func (l *Ledger) State() map[string][]byte {
+	return l.state.State
+}
+
+// PrivateState returns the committed state of a private data collection.
+func (l *Ledger) PrivateState(collection string) map[string][]byte {
+	return l.collection(collection).State
+}
+
+// write is one entry of a write set; a nil value deletes the key.
+type write struct {
+	collection string
+	key        string
+	value      []byte
+}
+
+// Event is a chaincode event set by a transaction.
+type Event struct {
+	Name    string
+	Payload []byte
+}
+
+// Tx is a transaction being endorsed. It is the stub the chaincode is invoked with.
+type Tx struct {
+	*shim.MockStub // the methods the ledger does not need to change
+
+	ledger    *Ledger
+	txID      string
+	timestamp *timestamp.Timestamp
+	args      [][]byte
+	creator   []byte
+	transient map[string][]byte
+	reads     []string
+	readSeen  map[string]bool
+	writes    []write
+	writeAt   map[string]int
+	event     *Event
+}
+
+// NewTx starts a transaction invoking the chaincode with args as the identity.
+func (l *Ledger) NewTx(id *Identity, transient map[string][]byte, args ...string) *Tx {
+	l.txCount++
+	now := time.Now()
+	if l.Clock != nil {
+		now = l.Clock()
+	}
+	tx := &Tx{
+		MockStub:  shim.NewMockStub("tx", nil),
+		ledger:    l,
+		txID:      fmt.Sprintf("tx%06d", l.txCount),
+		timestamp: &timestamp.Timestamp{Seconds: now.Unix(), Nanos: int32(now.Nanosecond())},
+		transient: transient,
+		readSeen:  make(map[string]bool),
+		writeAt:   make(map[string]int),
+	}
+	if id != nil {
+		tx.creator = id.Creator
+	}
+	for _, arg := range args {
+		tx.args = append(tx.args, []byte(arg))
+	}
+	return tx
+}
+
+// Init endorses and, when it succeeds, commits a call to the chaincode's Init.
+func (l *Ledger) Init(cc shim.Chaincode, id *Identity, args ...string) pb.Response {
+	tx := l.NewTx(id, nil, append([]string{"init"}, args...)...)
+	response := cc.Init(tx)
+	if response.Status == shim.OK {
+		l.Commit(tx)
+	}
+	return response
+}
+
+// Endorse invokes the chaincode without committing anything.
+func (l *Ledger) Endorse(cc shim.Chaincode, id *Identity, transient map[string][]byte, args ...string) (pb.Response, *Tx) {
+	tx := l.NewTx(id, transient, args...)
+	return cc.Invoke(tx), tx
+}
+
+// Invoke endorses a transaction and commits it when the chaincode succeeds, as a block of
+// one transaction.
+func (l *Ledger) Invoke(cc shim.Chaincode, id *Identity, transient map[string][]byte, args ...string) (pb.Response, *Tx) {
+	response, tx := l.Endorse(cc, id, transient, args...)
+	if response.Status == shim.OK {
+		l.Commit(tx)
+	}
+	return response, tx
+}
+
+// Commit applies the write set of the transaction and records it in the history.
+func (l *Ledger) Commit(tx *Tx) {
+	l.state.MockTransactionStart(tx.txID)
+	for _, w := range tx.writes {
+		store := l.state
+		if w.collection != "" {
+			store = l.collection(w.collection)
+			store.MockTransactionStart(tx.txID)
+		}
+		if w.value == nil {
+			store.DelState(w.key)
+		} else {
+			store.PutState(w.key, w.value)
+		}
+		if w.collection == "" {
+			l.history[w.key] = append(l.history[w.key], &queryresult.KeyModification{
+				TxId: tx.txID, Value: w.value, Timestamp: tx.timestamp, IsDelete: w.value == nil,
+			})
+		}
+	}
+	l.state.MockTransactionEnd(tx.txID)
+}
+
+// CommitBlock validates the transactions of a block, all endorsed against the current
+// state, in order with Fabric's MVCC rule: a transaction is invalid if it read a key that
+// an earlier valid transaction of the block wrote. Only valid transactions are committed.
+func (l *Ledger) CommitBlock(txs []*Tx) []bool {
+	valid := make([]bool, len(txs))
+	written := make(map[string]bool)
+	for i, tx := range txs {
+		valid[i] = true
+		for _, key := range tx.reads {
+			if written[key] {
+				valid[i] = false
+				break
+			}
+		}
+		if !valid[i] {
+			continue
+		}
+		for _, w := range tx.writes {
+			written[versionKey(w.collection, w.key)] = true
+		}
+		l.Commit(tx)
+	}
+	return valid
+}
+
+// versionKey names a key of the public state or of a collection in read and write sets.
+func versionKey(collection string, key string) string {
+	if collection == "" {
+		return key
+	}
+	return collection + "/" + key
+}
+
+// ReadSet returns the keys the transaction read, private ones prefixed with their
+// collection, in the order first read.
+func (tx *Tx) ReadSet() []string {
+	return tx.reads
+}
+
+// WriteSet returns the keys the transaction writes or deletes, private ones prefixed with
+// their collection.
+func (tx *Tx) WriteSet() []string {
+	var keys []string
+	for _, w := range tx.writes {
+		keys = append(keys, versionKey(w.collection, w.key))
+	}
+	return keys
+}
+
+// Event returns the chaincode event the transaction set, if any.
+func (tx *Tx) Event() *Event {
+	return tx.event
+}
+
+func (tx *Tx) read(collection string, key string) {
+	id := versionKey(collection, key)
+	if !tx.readSeen[id] {
+		tx.readSeen[id] = true
+		tx.reads = append(tx.reads, id)
+	}
+}
+
+func (tx *Tx) write(collection string, key string, value []byte) error {
+	if key == "" {
+		return errors.New("key must not be an empty string")
+	}
+	id := versionKey(collection, key)
+	if i, ok := tx.writeAt[id]; ok {
+		tx.writes[i].value = value
+		return nil
+	}
+	tx.writeAt[id] = len(tx.writes)
+	tx.writes = append(tx.writes, write{collection, key, value})
+	return nil
+}
+
+func (tx *Tx) GetArgs() [][]byte {
+	return tx.args
+}
+
+func (tx *Tx) GetStringArgs() []string {
+	var args []string
+	for _, arg := range tx.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (tx *Tx) GetFunctionAndParameters() (string, []string) {
+	args := tx.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (tx *Tx) GetArgsSlice() ([]byte, error) {
+	var slice []byte
+	for _, arg := range tx.args {
+		slice = append(slice, arg...)
+	}
+	return slice, nil
+}
+
+func (tx *Tx) GetTxID() string {
+	return tx.txID
+}
+
+func (tx *Tx) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return tx.timestamp, nil
+}
+
+func (tx *Tx) GetCreator() ([]byte, error) {
+	return tx.creator, nil
+}
+
+func (tx *Tx) GetTransient() (map[string][]byte, error) {
+	return tx.transient, nil
+}
+
+func (tx *Tx) GetSignedProposal() (*pb.SignedProposal, error) {
+	return &pb.SignedProposal{}, nil
+}
+
+func (tx *Tx) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return errors.New("event name can not be nil string")
+	}
+	tx.event = &Event{name, payload}
+	return nil
+}
+
+// GetState reads the committed state: a transaction does not see its own writes.
+func (tx *Tx) GetState(key string) ([]byte, error) {
+	tx.read("", key)
+	return tx.ledger.state.State[key], nil
+}
+
+func (tx *Tx) PutState(key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	return tx.write("", key, value)
+}
+
+func (tx *Tx) DelState(key string) error {
+	return tx.write("", key, nil)
+}
+
+func (tx *Tx) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	it, err := tx.ledger.state.GetStateByRange(startKey, endKey)
+	return &recordingIterator{it, tx, ""}, err
+}
+
+func (tx *Tx) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	it, err := tx.ledger.state.GetStateByPartialCompositeKey(objectType, attributes)
+	return &recordingIterator{it, tx, ""}, err
+}
+
+func (tx *Tx) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errors.New("rich queries need CouchDB and are not supported in memory")
+}
+
+func (tx *Tx) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{entries: tx.ledger.history[key]}, nil
+}
+
+func (tx *Tx) GetPrivateData(collection, key string) ([]byte, error) {
+	tx.read(collection, key)
+	return tx.ledger.collection(collection).State[key], nil
+}
+
+func (tx *Tx) PutPrivateData(collection string, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	return tx.write(collection, key, value)
+}
+
+func (tx *Tx) DelPrivateData(collection, key string) error {
+	return tx.write(collection, key, nil)
+}
+
+func (tx *Tx) GetPrivateDataByRange(collection, startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	it, err := tx.ledger.collection(collection).GetStateByRange(startKey, endKey)
+	return &recordingIterator{it, tx, collection}, err
+}
+
+func (tx *Tx) GetPrivateDataByPartialCompositeKey(collection, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	it, err := tx.ledger.collection(collection).GetStateByPartialCompositeKey(objectType, attributes)
+	return &recordingIterator{it, tx, collection}, err
+}
+
+func (tx *Tx) GetPrivateDataQueryResult(collection, query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errors.New("rich queries need CouchDB and are not supported in memory")
+}
+
+// recordingIterator adds the keys a range query returns to the read set.
+type recordingIterator struct {
+	shim.StateQueryIteratorInterface
+	tx         *Tx
+	collection string
+}
+
+func (it *recordingIterator) Next() (*queryresult.KV, error) {
+	kv, err := it.StateQueryIteratorInterface.Next()
+	if err == nil && kv != nil {
+		it.tx.read(it.collection, kv.Key)
+	}
+	return kv, err
+}
+
+// historyIterator returns the committed modifications of a key, oldest first as a Fabric
+// 1.4 peer does.
+type historyIterator struct {
+	entries []*queryresult.KeyModification
+	next    int
+}
+
+func (it *historyIterator) HasNext() bool {
+	return it.next < len(it.entries)
+}
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if !it.HasNext() {
+		return nil, errors.New("no more history")
+	}
+	it.next++
+	return it.entries[it.next-1], nil
+}
+
+func (it *historyIterator) Close() error {
+	return nil
+}
+
+// Size returns the number of keys and bytes (keys and values) of the committed public
+// state and private data collections.
+func (l *Ledger) Size() (keys int, bytes int) {
+	stores := []*shim.MockStub{l.state}
+	var names []string
+	for name := range l.private {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stores = append(stores, l.private[name])
+	}
+	for _, store := range stores {
+		for key, value := range store.State {
+			keys++
+			bytes += len(key) + len(value)
+		}
+	}
+	return keys, bytes
+}
+
+// Keys returns the committed public keys starting with prefix, sorted.
+func (l *Ledger) Keys(prefix string) []string {
+	var keys []string
+	for key := range l.state.State {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// snapshot is the JSON form of a ledger written by Save.
+type snapshot struct {
+	TxCount int                          `json:"tx_count"`
+	State   map[string][]byte            `json:"state"`
+	Private map[string]map[string][]byte `json:"private,omitempty"`
+	History map[string][]historyEntry    `json:"history,omitempty"`
+}
+
+type historyEntry struct {
+	TxID      string    `json:"tx_id"`
+	Value     []byte    `json:"value,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	IsDelete  bool      `json:"is_delete,omitempty"`
+}
+
+// Save writes the committed state, private data and history as JSON, so that a ledger can
+// outlive the process, as for the command-line client.
+func (l *Ledger) Save(w io.Writer) error {
+	s := snapshot{TxCount: l.txCount, State: l.state.State, Private: make(map[string]map[string][]byte),
+		History: make(map[string][]historyEntry)}
+	for name, store := range l.private {
+		s.Private[name] = store.State
+	}
+	for key, changes := range l.history {
+		for _, change := range changes {
+			s.History[key] = append(s.History[key], historyEntry{change.TxId, change.Value,
+				time.Unix(change.Timestamp.GetSeconds(), int64(change.Timestamp.GetNanos())).UTC(), change.IsDelete})
+		}
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+// Load reads a ledger written by Save.
+func Load(r io.Reader) (*Ledger, error) {
+	s := snapshot{}
+	err := json.NewDecoder(r).Decode(&s)
+	if err != nil {
+		return nil, fmt.Errorf("reading ledger: %v", err)
+	}
+	l := NewLedger()
+	l.txCount = s.TxCount
+	load := func(store *shim.MockStub, state map[string][]byte) {
+		store.MockTransactionStart("load")
+		for key, value := range state {
+			store.PutState(key, value)
+		}
+		store.MockTransactionEnd("load")
+	}
+	load(l.state, s.State)
+	for name, state := range s.Private {
+		load(l.collection(name), state)
+	}
+	for key, changes := range s.History {
+		for _, change := range changes {
+			l.history[key] = append(l.history[key], &queryresult.KeyModification{
+				TxId: change.TxID, Value: change.Value, IsDelete: change.IsDelete,
+				Timestamp: &timestamp.Timestamp{Seconds: change.Timestamp.Unix(), Nanos: int32(change.Timestamp.Nanosecond())},
+			})
+		}
+	}
+	return l, nil
+}
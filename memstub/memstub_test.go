@@ -0,0 +1,135 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package memstub
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// counter increments keys: "inc k" reads k and writes k+1 (as one byte), "fail k" writes
+// k and then fails, "role" returns the caller's consentio.role attribute.
+type counter struct{}
+
+func (counter) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (counter) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	switch function {
+	case "inc":
+		value, _ := stub.GetState(args[0])
+		next := []byte{1}
+		if value != nil {
+			next[0] = value[0] + 1
+		}
+		stub.PutState(args[0], next)
+		// a transaction does not read its own writes
+		again, _ := stub.GetState(args[0])
+		if len(again) != len(value) {
+			return shim.Error("read own write")
+		}
+		return shim.Success(next)
+	case "fail":
+		stub.PutState(args[0], []byte{9})
+		return shim.Error("failed")
+	case "role":
+		role, _, err := cid.GetAttributeValue(stub, "consentio.role")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success([]byte(role))
+	}
+	return shim.Error("unknown function")
+}
+
+func TestInvokeCommitsOnlySuccess(t *testing.T) {
+	l := NewLedger()
+	response, _ := l.Invoke(counter{}, nil, nil, "inc", "a")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	response, _ = l.Invoke(counter{}, nil, nil, "inc", "a")
+	if response.Status != shim.OK || response.Payload[0] != 2 {
+		t.Fatalf("second increment = %v %s", response.Payload, response.Message)
+	}
+	l.Invoke(counter{}, nil, nil, "fail", "b")
+	if l.State()["b"] != nil {
+		t.Errorf("failed transaction was committed")
+	}
+	if len(l.history["a"]) != 2 {
+		t.Errorf("history of a has %d entries, want 2", len(l.history["a"]))
+	}
+}
+
+func TestCommitBlockMVCC(t *testing.T) {
+	l := NewLedger()
+	var txs []*Tx
+	for _, key := range []string{"a", "b", "a", "c", "b"} {
+		_, tx := l.Endorse(counter{}, nil, nil, "inc", key)
+		txs = append(txs, tx)
+	}
+	valid := l.CommitBlock(txs)
+	want := []bool{true, true, false, true, false}
+	for i := range want {
+		if valid[i] != want[i] {
+			t.Errorf("transaction %d valid = %v, want %v", i, valid[i], want[i])
+		}
+	}
+	// the invalid increments were not applied
+	for _, key := range []string{"a", "b", "c"} {
+		if value := l.State()[key]; len(value) != 1 || value[0] != 1 {
+			t.Errorf("%s = %v, want 1", key, value)
+		}
+	}
+}
+
+func TestIdentityAttributes(t *testing.T) {
+	id, err := NewIdentity("Org1MSP", "someone", map[string]string{"consentio.role": "custodian"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _ := NewLedger().Invoke(counter{}, id, nil, "role")
+	if response.Status != shim.OK || string(response.Payload) != "custodian" {
+		t.Errorf("role = %q %s", response.Payload, response.Message)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	l := NewLedger()
+	l.Invoke(counter{}, nil, nil, "inc", "a")
+	l.Invoke(counter{}, nil, nil, "inc", "b")
+	var buf bytes.Buffer
+	err := l.Save(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := loaded.Keys(""); len(keys) != 2 || len(loaded.history["a"]) != 1 {
+		t.Errorf("loaded keys %v, history %v", keys, loaded.history)
+	}
+	// transaction ids carry on and range queries see the loaded keys
+	response, tx := loaded.Invoke(counter{}, nil, nil, "inc", "a")
+	if response.Status != shim.OK || response.Payload[0] != 2 || tx.GetTxID() != "tx000003" {
+		t.Errorf("increment after load = %v %s in %s", response.Payload, response.Message, tx.GetTxID())
+	}
+	iterator, _ := loaded.NewTx(nil, nil).GetStateByRange("", "")
+	count := 0
+	for iterator.HasNext() {
+		iterator.Next()
+		count++
+	}
+	if count != 2 {
+		t.Errorf("range query after load found %d keys", count)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package merkle computes the Merkle tree commitments the IWS chaincode keeps for the
+// patient set of each consent record, and verifies inclusion proofs against them offline.
+//
+// Trees follow RFC 6962: a leaf is hashed as SHA-256(0x00 || leaf), an inner node as
+// SHA-256(0x01 || left || right), and a tree of n > 1 leaves is split after the largest
+// power of two smaller than n. The leaves of a patient set are its patient ids, as
+// stored, in sorted order.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// LeafHash returns the hash of a leaf.
+func LeafHash(leaf []byte) []byte {
+	sum := sha256.Sum256(append([]byte{0x00}, leaf...))
+	return sum[:]
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// split returns the largest power of two smaller than n, for n > 1.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// Root returns the root hash of the tree over the leaves. The root of an empty tree is
+// the hash of the empty string.
+func Root(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return LeafHash(leaves[0])
+	}
+	k := split(len(leaves))
+	return nodeHash(Root(leaves[:k]), Root(leaves[k:]))
+}
+
+// Path returns the audit path of the leaf at index: the sibling hashes from the leaf up
+// to the root.
+func Path(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 || index < 0 || index >= len(leaves) {
+		return nil
+	}
+	k := split(len(leaves))
+	if index < k {
+		return append(Path(leaves[:k], index), Root(leaves[k:]))
+	}
+	return append(Path(leaves[k:], index-k), Root(leaves[:k]))
+}
+
+// Verify tells whether the path proves that leaf is at index in a tree of size leaves
+// with the given root (RFC 9162, section 2.1.3.2).
+func Verify(root, leaf []byte, index, size int, path [][]byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := LeafHash(leaf)
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// Proof is an inclusion proof with hex-encoded hashes, as returned by the chaincode's
+// getConsentProof.
+type Proof struct {
+	Leaf  string   `json:"leaf"`
+	Index int      `json:"index"`
+	Size  int      `json:"size"`
+	Path  []string `json:"path"`
+	Root  string   `json:"merkle_root"`
+}
+
+// NewProof returns the proof for the leaf at index.
+func NewProof(leaves [][]byte, index int) *Proof {
+	proof := &Proof{Leaf: string(leaves[index]), Index: index, Size: len(leaves), Path: []string{},
+		Root: hex.EncodeToString(Root(leaves))}
+	for _, p := range Path(leaves, index) {
+		proof.Path = append(proof.Path, hex.EncodeToString(p))
+	}
+	return proof
+}
+
+// Verify tells whether the proof is valid for its root. The caller still has to check
+// that the root is the one committed on the ledger.
+func (p *Proof) Verify() bool {
+	root, err := hex.DecodeString(p.Root)
+	if err != nil {
+		return false
+	}
+	var path [][]byte
+	for _, h := range p.Path {
+		node, err := hex.DecodeString(h)
+		if err != nil {
+			return false
+		}
+		path = append(path, node)
+	}
+	return Verify(root, []byte(p.Leaf), p.Index, p.Size, path)
+}
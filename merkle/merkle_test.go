@@ -0,0 +1,173 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package merkle
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// rfc6962Leaves are the leaves of the Certificate Transparency reference tests.
+var rfc6962Leaves = [][]byte{
+	{},
+	{0x00},
+	{0x10},
+	{0x20, 0x21},
+	{0x30, 0x31},
+	{0x40, 0x41, 0x42, 0x43},
+	{0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57},
+	{0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a, 0x6b, 0x6c, 0x6d, 0x6e, 0x6f},
+}
+
+// rfc6962Roots are the roots of the trees over the first 1 to 8 of rfc6962Leaves.
+var rfc6962Roots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func patients(n int) [][]byte {
+	var leaves [][]byte
+	for i := 0; i < n; i++ {
+		leaves = append(leaves, []byte(fmt.Sprintf("patient%03d", i)))
+	}
+	return leaves
+}
+
+func TestRootReferenceVectors(t *testing.T) {
+	for n, want := range rfc6962Roots {
+		got := hex.EncodeToString(Root(rfc6962Leaves[:n+1]))
+		if got != want {
+			t.Errorf("root of %d leaves = %s, want %s", n+1, got, want)
+		}
+	}
+}
+
+func TestRootEmpty(t *testing.T) {
+	got := hex.EncodeToString(Root(nil))
+	if got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("root of the empty tree = %s", got)
+	}
+}
+
+func TestProofRoundTrip(t *testing.T) {
+	// odd sizes and sizes around powers of two exercise the uneven splits
+	for _, n := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 13, 16, 17, 31, 33} {
+		leaves := patients(n)
+		root := hex.EncodeToString(Root(leaves))
+		for i := 0; i < n; i++ {
+			proof := NewProof(leaves, i)
+			if proof.Root != root {
+				t.Fatalf("size %d index %d: proof root %s, want %s", n, i, proof.Root, root)
+			}
+			if !proof.Verify() {
+				t.Errorf("size %d index %d: valid proof rejected", n, i)
+			}
+		}
+	}
+}
+
+func TestProofReferenceTree(t *testing.T) {
+	for i := range rfc6962Leaves {
+		proof := NewProof(rfc6962Leaves, i)
+		if proof.Root != rfc6962Roots[len(rfc6962Roots)-1] {
+			t.Fatalf("index %d: proof root %s", i, proof.Root)
+		}
+		if !proof.Verify() {
+			t.Errorf("index %d: valid proof rejected", i)
+		}
+	}
+}
+
+func TestProofWrongIndex(t *testing.T) {
+	for _, n := range []int{2, 3, 5, 8, 11} {
+		leaves := patients(n)
+		for i := 0; i < n; i++ {
+			for _, index := range []int{-1, n, n + 1, (i + 1) % n} {
+				proof := NewProof(leaves, i)
+				proof.Index = index
+				if proof.Verify() {
+					t.Errorf("size %d: proof of index %d accepted for index %d", n, i, index)
+				}
+			}
+		}
+	}
+}
+
+func TestProofWrongLeaf(t *testing.T) {
+	leaves := patients(7)
+	for i := range leaves {
+		proof := NewProof(leaves, i)
+		proof.Leaf = proof.Leaf + "x"
+		if proof.Verify() {
+			t.Errorf("index %d: proof accepted for another leaf", i)
+		}
+		// a leaf of the tree at another position does not verify either
+		proof = NewProof(leaves, i)
+		proof.Leaf = string(leaves[(i+1)%len(leaves)])
+		if proof.Verify() {
+			t.Errorf("index %d: proof accepted for the leaf at %d", i, (i+1)%len(leaves))
+		}
+	}
+}
+
+func TestProofWrongRoot(t *testing.T) {
+	leaves := patients(6)
+	other := hex.EncodeToString(Root(patients(5)))
+	for i := range leaves {
+		proof := NewProof(leaves, i)
+		proof.Root = other
+		if proof.Verify() {
+			t.Errorf("index %d: proof accepted for the root of another tree", i)
+		}
+		proof.Root = "not hex"
+		if proof.Verify() {
+			t.Errorf("index %d: proof accepted with a malformed root", i)
+		}
+	}
+}
+
+func TestProofWrongSizeOrPath(t *testing.T) {
+	leaves := patients(9)
+	for i := range leaves {
+		// the size is not committed by the root, but a tree of another shape needs a
+		// path of another length
+		proof := NewProof(leaves, i)
+		proof.Size = 17
+		if proof.Verify() {
+			t.Errorf("index %d: proof accepted for a tree of 17 leaves", i)
+		}
+		proof = NewProof(leaves, i)
+		proof.Path = proof.Path[:len(proof.Path)-1]
+		if proof.Verify() {
+			t.Errorf("index %d: proof accepted with a truncated path", i)
+		}
+		proof = NewProof(leaves, i)
+		proof.Path = append(proof.Path, proof.Root)
+		if proof.Verify() {
+			t.Errorf("index %d: proof accepted with an extra node", i)
+		}
+	}
+}
+
+func TestSingleLeafTree(t *testing.T) {
+	leaves := patients(1)
+	proof := NewProof(leaves, 0)
+	if len(proof.Path) != 0 {
+		t.Errorf("path of a single leaf tree = %v, want none", proof.Path)
+	}
+	if proof.Root != hex.EncodeToString(LeafHash(leaves[0])) {
+		t.Errorf("root of a single leaf tree is not its leaf hash")
+	}
+	if !proof.Verify() {
+		t.Errorf("proof of a single leaf tree rejected")
+	}
+}
@@ -0,0 +1,3166 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// ====CHAINCODE EXECUTION SAMPLES (CLI) ==================
+
+// ==== Invoke marbles ====
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble1","blue","35","tom"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble2","red","50","tom"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble3","blue","70","tom"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","marble2","jerry"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColor","blue","jerry"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["delete","marble1"]}'
+
+// ==== Query marbles ====
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readMarble","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRange","marble1","marble3"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1"]}'
+
+// Rich Query (Only supported if CouchDB is used as state database):
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwner","tom"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\"}}"]}'
+
+// Rich Query with Pagination (Only supported if CouchDB is used as state database):
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesWithPagination","{\"selector\":{\"owner\":\"tom\"}}","3",""]}'
+
+// INDEXES TO SUPPORT COUCHDB RICH QUERIES
+//
+// Indexes in CouchDB are required in order to make JSON queries efficient and are required for
+// any JSON query with a sort. As of Hyperledger Fabric 1.1, indexes may be packaged alongside
+// chaincode in a META-INF/statedb/couchdb/indexes directory. Each index must be defined in its own
+// text file with extension *.json with the index definition formatted in JSON following the
+// CouchDB index JSON syntax as documented at:
+// http://docs.couchdb.org/en/2.1.1/api/database/find.html#db-index
+//
+// This marbles02 example chaincode demonstrates a packaged
+// index which you can find in META-INF/statedb/couchdb/indexes/indexOwner.json.
+// For deployment of chaincode to production environments, it is recommended
+// to define any indexes alongside chaincode so that the chaincode and supporting indexes
+// are deployed automatically as a unit, once the chaincode has been installed on a peer and
+// instantiated on a channel. See Hyperledger Fabric documentation for more details.
+//
+// If you have access to the your peer's CouchDB state database in a development environment,
+// you may want to iteratively test various indexes in support of your chaincode queries.  You
+// can use the CouchDB Fauxton interface or a command line curl utility to create and update
+// indexes. Then once you finalize an index, include the index definition alongside your
+// chaincode in the META-INF/statedb/couchdb/indexes directory, for packaging and deployment
+// to managed environments.
+//
+// In the examples below you can find index definitions that support marbles02
+// chaincode queries, along with the syntax that you can use in development environments
+// to create the indexes in the CouchDB Fauxton interface or a curl command line utility.
+//
+
+//Example hostname:port configurations to access CouchDB.
+//
+//To access CouchDB docker container from within another docker container or from vagrant environments:
+// http://couchdb:5984/
+//
+//Inside couchdb docker container
+// http://127.0.0.1:5984/
+
+// Index for docType, owner.
+//
+// Example curl command line to define index in the CouchDB channel_chaincode database
+// curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[\"docType\",\"owner\"]},\"name\":\"indexOwner\",\"ddoc\":\"indexOwnerDoc\",\"type\":\"json\"}" http://hostname:port/myc1_marbles/_index
+//
+
+// Index for docType, owner, size (descending order).
+//
+// Example curl command line to define index in the CouchDB channel_chaincode database
+// curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[{\"size\":\"desc\"},{\"docType\":\"desc\"},{\"owner\":\"desc\"}]},\"ddoc\":\"indexSizeSortDoc\", \"name\":\"indexSizeSortDesc\",\"type\":\"json\"}" http://hostname:port/myc1_marbles/_index
+
+// Rich Query with index design doc and index name specified (Only supported if CouchDB is used as state database):
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"docType\":\"marble\",\"owner\":\"tom\"}, \"use_index\":[\"_design/indexOwnerDoc\", \"indexOwner\"]}"]}'
+
+// Rich Query with index design doc specified only (Only supported if CouchDB is used as state database):
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"docType\":{\"$eq\":\"marble\"},\"owner\":{\"$eq\":\"tom\"},\"size\":{\"$gt\":0}},\"fields\":[\"docType\",\"owner\",\"size\"],\"sort\":[{\"size\":\"desc\"}],\"use_index\":\"_design/indexSizeSortDoc\"}"]}'
+
+// Package rws is the RWS design of the Consentio chaincode: one record per patient and
+// consent setting, holding the columns consented to. chaincode/rws runs it on a peer.
+package rws
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// SimpleChaincode example simple Chaincode implementation
+type SimpleChaincode struct {
+}
+
+type marble struct {
+	uniqueID     string
+	UserID     string  `json:"u_id"`
+	RoleID       string  `json:"r_id"`
+	Start_date   string  `json:"s_date"`
+	End_date     string  `json:"e_date"` 
+	ColumnIDs    []string  `json:"c_ids"`
+	AccessType string `json:"acctype_id"`
+	State        int       `json:"state,omitempty"` // lifecycle state, see setConsentState
+}
+
+// state returns the lifecycle state of the consent; records written before states existed
+// hold active consents.
+func (m *marble) state() int {
+	if m.State == 0 {
+		return stateActive
+	}
+	return m.State
+}
+
+// watchdog is a registered authority tied to an MSP identity. It may only approve
+// (and be named in consents for) the roles listed in RoleIDs.
+type watchdog struct {
+	ObjectType string   `json:"docType"`
+	WatchdogID string   `json:"w_id"`
+	MSPID      string   `json:"msp_id"`
+	ClientID   string   `json:"client_id,omitempty"`
+	RoleIDs    []string `json:"r_ids"`
+}
+
+// governance lists the MSPs allowed to register, remove and configure watchdogs, and the
+// channel-wide consent settings chosen at instantiation.
+type governance struct {
+	ObjectType        string   `json:"docType"`
+	MSPIDs            []string `json:"msp_ids"`
+	RequirePseudonyms bool     `json:"require_pseudonyms,omitempty"` // patient ids must be registered pseudonyms
+	SecretCollection  string   `json:"secret_collection,omitempty"`  // private data collection for pseudonym secrets
+	ConsentCollection string   `json:"consent_collection,omitempty"` // private data collection for consent records
+	HashPatientIDs    bool     `json:"hash_patient_ids,omitempty"`   // patient ids are stored as salted hashes
+	ConsumerMSPIDs    []string `json:"consumer_msp_ids,omitempty"`   // MSPs of data consumers, any when empty
+}
+
+// Error codes returned in the JSON body of failed responses. Clients should branch on
+// these rather than on the message.
+const (
+	errInvalidArgument = "INVALID_ARGUMENT"
+	errNotFound        = "NOT_FOUND"
+	errUnauthorized    = "UNAUTHORIZED"
+	errConflict        = "CONFLICT"
+	errExpired         = "EXPIRED"
+	errInternal        = "INTERNAL"
+)
+
+// errorStatus is the response status sent with each error code.
+var errorStatus = map[string]int32{
+	errInvalidArgument: 400,
+	errUnauthorized:    403,
+	errNotFound:        404,
+	errConflict:        409,
+	errExpired:         410,
+	errInternal:        shim.ERROR,
+}
+
+// chaincodeError is a failure with a stable code. Details carries structured context such
+// as the per-item report of bulkUpdateConsent.
+type chaincodeError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *chaincodeError) Error() string {
+	return e.Message
+}
+
+func newError(code string, format string, a ...interface{}) error {
+	return &chaincodeError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// errorCode returns the code of err, errors without one being INTERNAL.
+func errorCode(err error) string {
+	if cerr, ok := err.(*chaincodeError); ok {
+		return cerr.Code
+	}
+	return errInternal
+}
+
+// errorResponse turns err into a failed response carrying the JSON error both as the
+// message and as the payload, with the status of its code.
+func errorResponse(err error) pb.Response {
+	cerr, ok := err.(*chaincodeError)
+	if !ok {
+		cerr = &chaincodeError{Code: errInternal, Message: err.Error()}
+	}
+	errJSONasBytes, _ := json.Marshal(cerr)
+	return pb.Response{Status: errorStatus[cerr.Code], Message: string(errJSONasBytes), Payload: errJSONasBytes}
+}
+
+// Kinds of chaincode function argument.
+const (
+	argText = iota // a string
+	argList        // comma-separated when positional, a string array in JSON
+	argJSON        // a JSON document, passed as a string when positional
+	argNumber      // a whole number, a JSON number or string in JSON
+)
+
+// argSpec describes one argument of a chaincode function, in positional order.
+type argSpec struct {
+	Name     string
+	Kind     int
+	Required bool
+	Default  string
+}
+
+// params holds the arguments of an invocation by name.
+type params map[string]string
+
+// list splits a list argument, dropping empty items.
+func (p params) list(name string) []string {
+	var items []string
+	for _, item := range strings.Split(p[name], ",") {
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseArgs reads the arguments of an invocation against specs. They are either given
+// positionally or as a single JSON object with named fields, so clients do not depend on
+// the argument order. Any argument can instead be given as the transient data entry of
+// the same name, which is not recorded in the block; positional arguments then fill the
+// leading arguments and may be left empty. Required arguments must be non-empty and the
+// others take their default when absent or empty.
+func parseArgs(args []string, transient map[string][]byte, specs []argSpec) (params, error) {
+	p := make(params)
+	named, err := namedArgs(args, specs)
+	if err != nil {
+		return nil, err
+	}
+	if named != nil {
+		for name, value := range named {
+			spec := -1
+			for i := range specs {
+				if specs[i].Name == name {
+					spec = i
+				}
+			}
+			if spec == -1 {
+				return nil, newError(errInvalidArgument, "Unknown argument %s", name)
+			}
+			p[name], err = argValue(specs[spec], value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		required := 0
+		for i, spec := range specs {
+			if _, ok := transient[spec.Name]; spec.Required && !ok {
+				required = i + 1
+			}
+		}
+		if len(args) < required || len(args) > len(specs) {
+			if required == len(specs) {
+				return nil, newError(errInvalidArgument, "Incorrect number of arguments. Expecting %d", len(specs))
+			}
+			return nil, newError(errInvalidArgument, "Incorrect number of arguments. Expecting %d to %d", required, len(specs))
+		}
+		for i, arg := range args {
+			p[specs[i].Name] = arg
+		}
+	}
+	for _, spec := range specs {
+		value, ok := transient[spec.Name]
+		if !ok {
+			continue
+		}
+		if len(p[spec.Name]) > 0 {
+			return nil, newError(errInvalidArgument, "%s is given both as an argument and in the transient data", spec.Name)
+		}
+		p[spec.Name], err = transientValue(spec, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range specs {
+		if len(p[spec.Name]) > 0 {
+			continue
+		}
+		if spec.Required {
+			return nil, newError(errInvalidArgument, "%s must be a non-empty string", spec.Name)
+		}
+		p[spec.Name] = spec.Default
+	}
+	return p, nil
+}
+
+// namedArgs returns the fields of the JSON object given as the only argument, or nil when
+// the arguments are positional. A function of one argument only takes the object as named
+// arguments when it has that field, so a bare JSON query is still positional.
+func namedArgs(args []string, specs []argSpec) (map[string]interface{}, error) {
+	if len(args) != 1 || !strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		return nil, nil
+	}
+	var named map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(args[0]))
+	decoder.UseNumber()
+	err := decoder.Decode(&named)
+	if len(specs) == 1 {
+		if _, ok := named[specs[0].Name]; err != nil || !ok {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, newError(errInvalidArgument, "Arguments must be a JSON object: %s", err.Error())
+	}
+	return named, nil
+}
+
+// transientValue converts a transient data entry to its positional string form. Lists
+// may be given as a JSON array.
+func transientValue(spec argSpec, value []byte) (string, error) {
+	if spec.Kind != argList || !bytes.HasPrefix(bytes.TrimSpace(value), []byte("[")) {
+		return string(value), nil
+	}
+	var items []interface{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	err := decoder.Decode(&items)
+	if err != nil {
+		return "", newError(errInvalidArgument, "%s is not a valid JSON array: %s", spec.Name, err.Error())
+	}
+	return argValue(spec, items)
+}
+
+// argValue converts a named JSON argument to its positional string form. Text must be
+// given as a JSON string and list items, which are joined with commas, may not contain one.
+func argValue(spec argSpec, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		if spec.Kind == argNumber {
+			return v.String(), nil
+		}
+	}
+	if spec.Kind == argJSON {
+		valueAsBytes, err := json.Marshal(value)
+		if err != nil {
+			return "", newError(errInvalidArgument, "%s is not valid JSON: %s", spec.Name, err.Error())
+		}
+		return string(valueAsBytes), nil
+	}
+	if items, ok := value.([]interface{}); ok && spec.Kind == argList {
+		list := make([]string, len(items))
+		for i, item := range items {
+			v, ok := item.(string)
+			if !ok {
+				return "", newError(errInvalidArgument, "%s must be an array of strings", spec.Name)
+			} else if strings.Contains(v, ",") {
+				return "", newError(errInvalidArgument, "%s items must not contain a comma", spec.Name)
+			}
+			list[i] = v
+		}
+		return strings.Join(list, ","), nil
+	}
+	switch spec.Kind {
+	case argText:
+		return "", newError(errInvalidArgument, "%s must be a string", spec.Name)
+	case argNumber:
+		return "", newError(errInvalidArgument, "%s must be a number", spec.Name)
+	}
+	return "", newError(errInvalidArgument, "%s has the wrong type", spec.Name)
+}
+
+// Init initializes chaincode
+// The arguments are the MSP ids allowed to govern watchdogs, or a single JSON governance
+// object ({"msp_ids":[...],"require_pseudonyms":true,...}). On upgrade they are merged
+// into the existing governance record: MSP ids replace the governors and a JSON object
+// replaces only the fields it names. When none are given the existing record is kept, or
+// the instantiating MSP becomes the only governor.
+// ===========================
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	govKey, err := stub.CreateCompositeKey("governance", []string{})
+	if err != nil {
+		return errorResponse(err)
+	}
+	govAsBytes, err := stub.GetState(govKey)
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to get governance: %s", err.Error()))
+	}
+	current := &governance{}
+	if govAsBytes != nil {
+		if len(args) == 0 {
+			return shim.Success(nil)
+		}
+		err = json.Unmarshal(govAsBytes, current)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	gov := &governance{}
+	*gov = *current
+	if len(args) == 1 && strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		err = json.Unmarshal([]byte(args[0]), gov)
+		if err != nil {
+			return errorResponse(newError(errInvalidArgument, "Governance must be a JSON object: %s", err.Error()))
+		}
+	} else if len(args) > 0 {
+		gov.MSPIDs = args
+	}
+	if govAsBytes != nil {
+		err = checkGovernanceChange(stub, current, gov)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	if len(gov.MSPIDs) == 0 {
+		msp_id, err := cid.GetMSPID(stub)
+		if err != nil {
+			return errorResponse(newError(errInternal, "Failed to get client MSP id: %s", err.Error()))
+		}
+		gov.MSPIDs = []string{msp_id}
+	}
+	if gov.HashPatientIDs {
+		err = storeSalt(stub, gov)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	gov.ObjectType = "governance"
+	govJSONasBytes, err := json.Marshal(gov)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(govKey, govJSONasBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+// checkGovernanceChange rejects an upgrade that changes how patients and consent records
+// are stored once there are any: records and keys written under the old settings would
+// no longer be found.
+func checkGovernanceChange(stub shim.ChaincodeStubInterface, current *governance, gov *governance) error {
+	if gov.HashPatientIDs == current.HashPatientIDs && gov.ConsentCollection == current.ConsentCollection && gov.RequirePseudonyms == current.RequirePseudonyms {
+		return nil
+	}
+	store := &consentStore{stub, current.ConsentCollection}
+	resultsIterator, err := store.byPartialCompositeKey(patientIndex, []string{})
+	if err != nil {
+		return newError(errInternal, "Failed to get consent records: %s", err.Error())
+	}
+	defer resultsIterator.Close()
+	found := resultsIterator.HasNext()
+	if !found {
+		keysIterator, err := stub.GetStateByPartialCompositeKey("patientKey", []string{})
+		if err != nil {
+			return newError(errInternal, "Failed to get patient keys: %s", err.Error())
+		}
+		defer keysIterator.Close()
+		found = keysIterator.HasNext()
+	}
+	if found {
+		return newError(errConflict, "hash_patient_ids, consent_collection and require_pseudonyms cannot be changed once consent has been recorded")
+	}
+	return nil
+}
+
+// Invoke - Our entry point for Invocations
+// ========================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	fmt.Println("invoke is running " + function)
+
+	// Handle different functions
+	fn, ok := functions[function]
+	if !ok {
+		fmt.Println("invoke did not find func: " + function) //error
+		return errorResponse(newError(errInvalidArgument, "Received unknown function invocation"))
+	}
+	err := authorize(stub, fn.roles)
+	if err != nil {
+		return errorResponse(err)
+	}
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to get transient data: %s", err.Error()))
+	}
+	p, err := parseArgs(args, transient, fn.args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if fn.readOnly {
+		stub = readOnlyStub{stub}
+	}
+	return fn.handler(t, stub, p)
+}
+
+// chaincodeFunction describes a function that can be invoked: its handler, its arguments,
+// whether it may write to the ledger and which client roles may call it.
+type chaincodeFunction struct {
+	handler  func(t *SimpleChaincode, stub shim.ChaincodeStubInterface, p params) pb.Response
+	args     []argSpec
+	readOnly bool
+	roles    []roleGrant
+}
+
+// functions is the table Invoke dispatches on.
+var functions = map[string]chaincodeFunction{
+	"accessConsent":           {(*SimpleChaincode).accessConsent, accessConsentArgs, false, []roleGrant{asConsumer}},
+	"explainAccess":           {(*SimpleChaincode).explainAccess, accessConsentArgs, true, []roleGrant{asConsumer, asCustodian, asAdmin}},
+	"queryMarbles":            {(*SimpleChaincode).queryMarbles, queryArgs, true, []roleGrant{asCustodian, asAdmin}}, //find marbles based on an ad hoc rich query
+	"updateConsent":           {(*SimpleChaincode).updateConsent, updateConsentArgs, false, []roleGrant{asPatient, asCustodian}},
+	"bulkUpdateConsent":       {(*SimpleChaincode).bulkUpdateConsent, bulkUpdateConsentArgs, false, []roleGrant{asCustodian}},
+	"registerWatchdog":        {(*SimpleChaincode).registerWatchdog, registerWatchdogArgs, false, []roleGrant{asAdmin}},
+	"removeWatchdog":          {(*SimpleChaincode).removeWatchdog, watchdogArgs, false, []roleGrant{asAdmin}},
+	"setWatchdogRoles":        {(*SimpleChaincode).setWatchdogRoles, setWatchdogRolesArgs, false, []roleGrant{asAdmin}},
+	"getConsentHistory":       {(*SimpleChaincode).getConsentHistory, getConsentHistoryArgs, true, []roleGrant{asPatient, asCustodian, asAdmin}},
+	"getPatientConsents":      {(*SimpleChaincode).getPatientConsents, getPatientConsentsArgs, true, []roleGrant{asPatient, asCustodian, asAdmin}},
+	"setConsentState":         {(*SimpleChaincode).setConsentState, setConsentStateArgs, false, []roleGrant{asPatient, asCustodian}},
+	"sweepExpired":            {(*SimpleChaincode).sweepExpired, sweepExpiredArgs, false, []roleGrant{asCustodian, asAdmin}},
+	"withdrawAllConsent":      {(*SimpleChaincode).withdrawAllConsent, withdrawAllConsentArgs, false, []roleGrant{asPatient, asCustodian}},
+	"registerPseudonym":       {(*SimpleChaincode).registerPseudonym, registerPseudonymArgs, false, []roleGrant{asPatient, asCustodian}},
+	"registerPatientKey":      {(*SimpleChaincode).registerPatientKey, registerPatientKeyArgs, false, []roleGrant{asPatient, asCustodian}},
+	"retirePseudonym":         {(*SimpleChaincode).retirePseudonym, retirePseudonymArgs, false, []roleGrant{asPatient, asCustodian}},
+	"verifyConsentRecord":     {(*SimpleChaincode).verifyConsentRecord, verifyConsentRecordArgs, true, []roleGrant{asAnyone}},
+	"verifyConsentReceipt":    {(*SimpleChaincode).verifyConsentReceipt, verifyConsentReceiptArgs, true, []roleGrant{asAnyone}},
+	"verifyAccessCertificate": {(*SimpleChaincode).verifyAccessCertificate, verifyAccessCertificateArgs, true, []roleGrant{asCustodian, asAdmin, asConsumer}},
+	"readWatchdog":            {(*SimpleChaincode).readWatchdog, watchdogArgs, true, []roleGrant{asAnyone}},
+}
+
+// Client roles. All but admin are read from the consentio.role attribute of the client
+// certificate (a comma-separated list); admin is any client of a governing MSP.
+const (
+	roleAny       = "*"
+	roleAdmin     = "admin"
+	rolePatient   = "patient"
+	roleCustodian = "custodian"
+	roleWatchdog  = "watchdog"
+	roleConsumer  = "consumer"
+)
+
+// roleGrant is a client role together with the MSPs whose certificates may carry it. A
+// nil msps allows any MSP.
+type roleGrant struct {
+	role string
+	msps func(gov *governance) []string
+}
+
+func governingMSPs(gov *governance) []string { return gov.MSPIDs }
+
+func consumerMSPs(gov *governance) []string {
+	if len(gov.ConsumerMSPIDs) == 0 {
+		return nil
+	}
+	return gov.ConsumerMSPIDs
+}
+
+// The roles functions are granted to. Patients and custodians are enrolled by the
+// governing organisations; a watchdog's MSP is the one it was registered with, which the
+// functions it calls check themselves.
+var (
+	asAnyone    = roleGrant{roleAny, nil}
+	asAdmin     = roleGrant{roleAdmin, governingMSPs}
+	asPatient   = roleGrant{rolePatient, governingMSPs}
+	asCustodian = roleGrant{roleCustodian, governingMSPs}
+	asWatchdog  = roleGrant{roleWatchdog, nil}
+	asConsumer  = roleGrant{roleConsumer, consumerMSPs}
+)
+
+// authorize returns an error unless the client holds one of the roles under an MSP
+// allowed to issue it.
+func authorize(stub shim.ChaincodeStubInterface, grants []roleGrant) error {
+	var held []string
+	attr, found, err := cid.GetAttributeValue(stub, "consentio.role")
+	if err != nil {
+		return newError(errInternal, "Failed to get client role: %s", err.Error())
+	}
+	if found {
+		for _, role := range strings.Split(attr, ",") {
+			held = append(held, strings.TrimSpace(role))
+		}
+	}
+	var roles []string
+	var gov *governance
+	for _, grant := range grants {
+		roles = append(roles, grant.role)
+		if grant.role == roleAny {
+			return nil
+		} else if grant.role == roleAdmin {
+			err = assertGovernor(stub)
+			if err == nil || errorCode(err) != errUnauthorized {
+				return err
+			}
+			continue
+		} else if contains(held, grant.role) == -1 {
+			continue
+		} else if grant.msps == nil {
+			return nil
+		}
+		if gov == nil {
+			gov, err = getGovernance(stub)
+			if err != nil {
+				return err
+			}
+		}
+		msps := grant.msps(gov)
+		if msps == nil {
+			return nil
+		}
+		msp_id, err := cid.GetMSPID(stub)
+		if err != nil {
+			return newError(errInternal, "Failed to get client MSP id: %s", err.Error())
+		}
+		if contains(msps, msp_id) != -1 {
+			return nil
+		}
+	}
+	return newError(errUnauthorized, "Client role must be one of %s, issued by an MSP allowed to hold it", strings.Join(roles, ", "))
+}
+
+// readOnlyStub rejects the writes of functions declared read-only.
+type readOnlyStub struct {
+	shim.ChaincodeStubInterface
+}
+
+func (s readOnlyStub) PutState(key string, value []byte) error {
+	return newError(errInternal, "Read-only function cannot write %s", key)
+}
+
+func (s readOnlyStub) DelState(key string) error {
+	return newError(errInternal, "Read-only function cannot delete %s", key)
+}
+
+func (s readOnlyStub) PutPrivateData(collection string, key string, value []byte) error {
+	return newError(errInternal, "Read-only function cannot write %s", key)
+}
+
+func (s readOnlyStub) DelPrivateData(collection string, key string) error {
+	return newError(errInternal, "Read-only function cannot delete %s", key)
+}
+
+// ============================================================
+// Watchdog registry - only governing MSPs may change it
+// ============================================================
+
+// getGovernance reads the governance record written by Init.
+func getGovernance(stub shim.ChaincodeStubInterface) (*governance, error) {
+	govKey, err := stub.CreateCompositeKey("governance", []string{})
+	if err != nil {
+		return nil, err
+	}
+	govAsBytes, err := stub.GetState(govKey)
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get governance: %s", err.Error())
+	} else if govAsBytes == nil {
+		return nil, newError(errNotFound, "Governance has not been initialized")
+	}
+	gov := &governance{}
+	err = json.Unmarshal(govAsBytes, gov)
+	if err != nil {
+		return nil, err
+	}
+	return gov, nil
+}
+
+// assertGovernor returns an error unless the client belongs to a governing MSP.
+func assertGovernor(stub shim.ChaincodeStubInterface) error {
+	gov, err := getGovernance(stub)
+	if err != nil {
+		return err
+	}
+	msp_id, err := cid.GetMSPID(stub)
+	if err != nil {
+		return newError(errInternal, "Failed to get client MSP id: %s", err.Error())
+	}
+	if contains(gov.MSPIDs, msp_id) == -1 {
+		return newError(errUnauthorized, "Client MSP %s is not allowed to govern watchdogs", msp_id)
+	}
+	return nil
+}
+
+// getWatchdog returns the registered watchdog or nil if there is none.
+func getWatchdog(stub shim.ChaincodeStubInterface, w_id string) (*watchdog, error) {
+	wdKey, err := stub.CreateCompositeKey("watchdog", []string{w_id})
+	if err != nil {
+		return nil, err
+	}
+	wdAsBytes, err := stub.GetState(wdKey)
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get watchdog: %s", err.Error())
+	} else if wdAsBytes == nil {
+		return nil, nil
+	}
+	wd := &watchdog{}
+	err = json.Unmarshal(wdAsBytes, wd)
+	if err != nil {
+		return nil, err
+	}
+	return wd, nil
+}
+
+func putWatchdog(stub shim.ChaincodeStubInterface, wd *watchdog) error {
+	wdKey, err := stub.CreateCompositeKey("watchdog", []string{wd.WatchdogID})
+	if err != nil {
+		return err
+	}
+	wdJSONasBytes, err := json.Marshal(wd)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(wdKey, wdJSONasBytes)
+}
+
+// governedWatchdog returns the watchdog if it is registered and may govern the role.
+func governedWatchdog(stub shim.ChaincodeStubInterface, w_id string, r_id string) (*watchdog, error) {
+	wd, err := getWatchdog(stub, w_id)
+	if err != nil {
+		return nil, err
+	} else if wd == nil {
+		return nil, newError(errNotFound, "Watchdog %s is not registered", w_id)
+	}
+	if contains(wd.RoleIDs, r_id) == -1 {
+		return nil, newError(errUnauthorized, "Watchdog %s does not govern role %s", w_id, r_id)
+	}
+	return wd, nil
+}
+
+// watchdog id, msp id, client id (optional), arr[role ids] (optional)
+var registerWatchdogArgs = []argSpec{
+	{"watchdog_id", argText, true, ""},
+	{"msp_id", argText, true, ""},
+	{"client_id", argText, false, ""},
+	{"role_ids", argList, false, ""},
+}
+
+func (t *SimpleChaincode) registerWatchdog(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	w_id := strings.ToLower(p["watchdog_id"])
+	wd, err := getWatchdog(stub, w_id)
+	if err != nil {
+		return errorResponse(err)
+	} else if wd != nil {
+		return errorResponse(newError(errConflict, "Watchdog already registered: %s", w_id))
+	}
+	wd = &watchdog{ObjectType: "watchdog", WatchdogID: w_id, MSPID: p["msp_id"], ClientID: p["client_id"], RoleIDs: []string{}}
+	for _, r_id := range p.list("role_ids") {
+		wd.RoleIDs = append(wd.RoleIDs, strings.ToLower(r_id))
+	}
+	err = putWatchdog(stub, wd)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+// watchdog id
+var watchdogArgs = []argSpec{
+	{"watchdog_id", argText, true, ""},
+}
+
+func (t *SimpleChaincode) removeWatchdog(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	w_id := strings.ToLower(p["watchdog_id"])
+	wdKey, err := stub.CreateCompositeKey("watchdog", []string{w_id})
+	if err != nil {
+		return errorResponse(err)
+	}
+	// role approvals and consents naming a removed watchdog are kept but no longer honoured
+	err = stub.DelState(wdKey)
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to delete state: %s", err.Error()))
+	}
+	return shim.Success(nil)
+}
+
+// watchdog id, arr[role ids]
+var setWatchdogRolesArgs = []argSpec{
+	{"watchdog_id", argText, true, ""},
+	{"role_ids", argList, false, ""},
+}
+
+func (t *SimpleChaincode) setWatchdogRoles(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	w_id := strings.ToLower(p["watchdog_id"])
+	wd, err := getWatchdog(stub, w_id)
+	if err != nil {
+		return errorResponse(err)
+	} else if wd == nil {
+		return errorResponse(newError(errNotFound, "Watchdog is not registered: %s", w_id))
+	}
+	wd.RoleIDs = []string{}
+	for _, r_id := range p.list("role_ids") {
+		wd.RoleIDs = append(wd.RoleIDs, strings.ToLower(r_id))
+	}
+	err = putWatchdog(stub, wd)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+func (t *SimpleChaincode) readWatchdog(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	wd, err := getWatchdog(stub, strings.ToLower(p["watchdog_id"]))
+	if err != nil {
+		return errorResponse(err)
+	} else if wd == nil {
+		return errorResponse(newError(errNotFound, "Watchdog is not registered: %s", p["watchdog_id"]))
+	}
+	wdJSONasBytes, err := json.Marshal(wd)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(wdJSONasBytes)
+}
+
+// ============================================================
+// Pseudonym registry - patient ids on the ledger can be pseudonyms
+// ============================================================
+
+// pseudonym records whether a pseudonym may still be used. The patient it stands for is
+// not stored on the ledger: the pseudonym is the HMAC-SHA256 of the patient id under a
+// secret kept off-chain or in the secret collection, so once the secret is destroyed the
+// records under the pseudonym can no longer be linked to the patient.
+type pseudonym struct {
+	ObjectType string `json:"docType"`
+	Pseudonym  string `json:"pseudonym"`
+	Status     string `json:"status"` // active or retired
+}
+
+// keyedHash returns the hex HMAC-SHA256 of the value under the secret.
+func keyedHash(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func getPseudonym(stub shim.ChaincodeStubInterface, pn string) (*pseudonym, error) {
+	pnKey, err := stub.CreateCompositeKey("pseudonym", []string{pn})
+	if err != nil {
+		return nil, newError(errInvalidArgument, "Invalid pseudonym: %s", err.Error())
+	}
+	pnAsBytes, err := stub.GetState(pnKey)
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get pseudonym: %s", err.Error())
+	} else if pnAsBytes == nil {
+		return nil, nil
+	}
+	record := &pseudonym{}
+	err = json.Unmarshal(pnAsBytes, record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func putPseudonym(stub shim.ChaincodeStubInterface, record *pseudonym) error {
+	pnKey, err := stub.CreateCompositeKey("pseudonym", []string{record.Pseudonym})
+	if err != nil {
+		return newError(errInvalidArgument, "Invalid pseudonym: %s", err.Error())
+	}
+	pnJSONasBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(pnKey, pnJSONasBytes)
+}
+
+// checkPatient returns an error if the patient id may not be given consent: it is a
+// retired pseudonym, or pseudonyms are required and it is not a registered one.
+func checkPatient(stub shim.ChaincodeStubInterface, p_id string) error {
+	record, err := getPseudonym(stub, p_id)
+	if err != nil {
+		return err
+	} else if record != nil {
+		if record.Status != "active" {
+			return newError(errExpired, "Pseudonym %s has been retired", p_id)
+		}
+		return nil
+	}
+	gov, err := getGovernance(stub)
+	if err != nil {
+		return err
+	}
+	if gov.RequirePseudonyms {
+		return newError(errNotFound, "Patient id %s is not a registered pseudonym", p_id)
+	}
+	return nil
+}
+
+// patientKeys returns the function mapping patient ids to the form they are stored and
+// compared in: the ids themselves or, when the governance hashes patient ids, their
+// HMAC-SHA256 under the channel salt kept in the secret collection. Only the custodian,
+// who knows the salt, can map the hashes back to patients.
+func patientKeys(stub shim.ChaincodeStubInterface) (func(p_id string) string, error) {
+	gov, err := getGovernance(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !gov.HashPatientIDs {
+		return func(p_id string) string { return p_id }, nil
+	}
+	salt, err := stub.GetPrivateData(gov.SecretCollection, "patient_salt")
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get patient salt: %s", err.Error())
+	} else if len(salt) == 0 {
+		return nil, newError(errNotFound, "Patient salt has not been set")
+	}
+	return func(p_id string) string { return keyedHash(salt, p_id) }, nil
+}
+
+// patientKey maps a single patient id, see patientKeys.
+func patientKey(stub shim.ChaincodeStubInterface, p_id string) (string, error) {
+	keyOf, err := patientKeys(stub)
+	if err != nil {
+		return "", err
+	}
+	return keyOf(p_id), nil
+}
+
+// storeSalt keeps the salt given as the salt entry of the transient data of Init in the
+// secret collection. An upgrade may leave it out, but not change it, since the consents
+// stored under the old hashes would become unreachable.
+func storeSalt(stub shim.ChaincodeStubInterface, gov *governance) error {
+	if len(gov.SecretCollection) <= 0 {
+		return newError(errInvalidArgument, "hash_patient_ids needs a secret_collection to keep the salt in")
+	}
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return newError(errInternal, "Failed to get transient data: %s", err.Error())
+	}
+	current, err := stub.GetPrivateData(gov.SecretCollection, "patient_salt")
+	if err != nil {
+		return newError(errInternal, "Failed to get patient salt: %s", err.Error())
+	}
+	salt := transient["salt"]
+	if len(salt) == 0 && len(current) == 0 {
+		return newError(errInvalidArgument, "hash_patient_ids needs a salt in the transient data")
+	} else if len(salt) == 0 {
+		return nil
+	} else if len(current) > 0 && !bytes.Equal(salt, current) {
+		return newError(errConflict, "The patient salt cannot be changed")
+	}
+	return stub.PutPrivateData(gov.SecretCollection, "patient_salt", salt)
+}
+
+// patientPublicKey is a patient's own signing key. Once one is registered, every
+// updateConsent for the patient has to be signed with it, so that whoever submits the
+// transaction on the patient's behalf cannot forge the patient's consent.
+type patientPublicKey struct {
+	ObjectType string `json:"docType"`
+	PatientID  string `json:"patient_id"` // as stored
+	PublicKey  string `json:"public_key"` // PEM encoded PKIX, ECDSA or Ed25519
+}
+
+func getPatientPublicKey(stub shim.ChaincodeStubInterface, p_key string) (*patientPublicKey, crypto.PublicKey, error) {
+	key, err := stub.CreateCompositeKey("patientKey", []string{p_key})
+	if err != nil {
+		return nil, nil, newError(errInvalidArgument, "Invalid patient id: %s", err.Error())
+	}
+	keyAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, nil, newError(errInternal, "Failed to get patient key: %s", err.Error())
+	} else if keyAsBytes == nil {
+		return nil, nil, nil
+	}
+	record := &patientPublicKey{}
+	err = json.Unmarshal(keyAsBytes, record)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := parsePublicKey(record.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, pub, nil
+}
+
+// parsePublicKey accepts a PEM encoded ECDSA or Ed25519 public key.
+func parsePublicKey(pemKey string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, newError(errInvalidArgument, "public_key must be a PEM encoded PUBLIC KEY")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, newError(errInvalidArgument, "Invalid public key: %s", err.Error())
+	}
+	switch pub.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return pub, nil
+	}
+	return nil, newError(errInvalidArgument, "public_key must be an ECDSA or Ed25519 key")
+}
+
+// verifySignature checks a base64 signature of the message: ASN.1 DER over its SHA-256
+// for ECDSA, over the message itself for Ed25519.
+func verifySignature(pub crypto.PublicKey, message []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return newError(errInvalidArgument, "signature must be base64 encoded")
+	}
+	valid := false
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		rest, err := asn1.Unmarshal(sig, &rs)
+		if err == nil && len(rest) == 0 && rs.R != nil && rs.S != nil {
+			digest := sha256.Sum256(message)
+			valid = ecdsa.Verify(key, digest[:], rs.R, rs.S)
+		}
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, message, sig)
+	}
+	if !valid {
+		return newError(errUnauthorized, "Signature does not match the patient's key")
+	}
+	return nil
+}
+
+// signedOperation is the message a patient signs for updateConsent: the JSON encoding of
+// the operation, with ids lower-cased as the chaincode normalises them, and a nonce that
+// may be used only once.
+type signedOperation struct {
+	PatientID  string   `json:"patient_id"`
+	Action     string   `json:"action"`
+	RoleID     string   `json:"role_id"`
+	StartDate  string   `json:"start_date"`
+	EndDate    string   `json:"end_date"`
+	ColumnIDs  []string `json:"column_ids"`
+	WatchdogID string   `json:"watchdog_id"`
+	Nonce      string   `json:"nonce"`
+}
+
+// checkSignature verifies a normalised operation against the patient's registered key,
+// if there is one, and uses up its nonce.
+func checkSignature(stub shim.ChaincodeStubInterface, batch *consentBatch, op *consentOp, p_key string) error {
+	_, pub, err := getPatientPublicKey(stub, p_key)
+	if err != nil || pub == nil {
+		return err
+	}
+	if len(op.Signature) <= 0 || len(op.Nonce) <= 0 {
+		return newError(errUnauthorized, "Patient %s has a registered key, the operation must be signed with a nonce", op.PatientID)
+	}
+	message, err := json.Marshal(signedOperation{op.PatientID, op.Action, op.RoleID, op.StartDate, op.EndDate, op.ColumnIDs, op.WatchdogID, op.Nonce})
+	if err != nil {
+		return err
+	}
+	err = verifySignature(pub, message, op.Signature)
+	if err != nil {
+		return err
+	}
+	nonceKey, err := stub.CreateCompositeKey("patientNonce", []string{p_key, op.Nonce})
+	if err != nil {
+		return newError(errInvalidArgument, "Invalid nonce: %s", err.Error())
+	}
+	nonceAsBytes, err := stub.GetState(nonceKey)
+	if err != nil {
+		return newError(errInternal, "Failed to get nonce: %s", err.Error())
+	} else if nonceAsBytes != nil || batch.nonces[nonceKey] {
+		return newError(errConflict, "Nonce %s has already been used", op.Nonce)
+	}
+	batch.nonces[nonceKey] = true
+	return stub.PutState(nonceKey, []byte{0x00})
+}
+
+// ===== registerPatientKey ===============================================================
+// registerPatientKey registers the key a patient signs consent operations with. The first
+// key must be registered by the patient's own identity. Replacing a registered key needs
+// the signature, by the current key, of the JSON object {"patient_id":...,"public_key":...}
+// naming the new one, so a custodian can submit the replacement.
+// ========================================================================================
+// patient id (not needed when the caller is the patient), PEM public key, signature
+var registerPatientKeyArgs = []argSpec{
+	{"patient_id", argText, false, ""},
+	{"public_key", argText, true, ""},
+	{"signature", argText, false, ""},
+}
+
+func (t *SimpleChaincode) registerPatientKey(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	p_id, err := resolvePatient(stub, p["patient_id"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	_, err = parsePublicKey(p["public_key"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	p_key, err := patientKey(stub, p_id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	_, current, err := getPatientPublicKey(stub, p_key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if current == nil {
+		// resolvePatient only lets a patient name itself, but a custodian may name anyone
+		// and must not choose the key that patient's consent is signed with
+		caller, found, err := cid.GetAttributeValue(stub, "consentio.patient_id")
+		if err != nil {
+			return errorResponse(newError(errInternal, "Failed to get client patient id: %s", err.Error()))
+		} else if !found || len(caller) <= 0 {
+			return errorResponse(newError(errUnauthorized, "The first key of patient %s must be registered by the patient", p_id))
+		}
+	} else {
+		if len(p["signature"]) <= 0 {
+			return errorResponse(newError(errConflict, "Patient %s already has a key, replacing it needs a signature by that key", p_id))
+		}
+		message, _ := json.Marshal(map[string]string{"patient_id": p_id, "public_key": p["public_key"]})
+		err = verifySignature(current, message, p["signature"])
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	key, err := stub.CreateCompositeKey("patientKey", []string{p_key})
+	if err != nil {
+		return errorResponse(newError(errInvalidArgument, "Invalid patient id: %s", err.Error()))
+	}
+	recordJSONasBytes, err := json.Marshal(&patientPublicKey{"patientKey", p_key, p["public_key"]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(key, recordJSONasBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+// ===== registerPseudonym ================================================================
+// registerPseudonym registers a pseudonym derived off-chain, or derives it from the
+// patient_id and secret entries of the transient map so that neither is written to the
+// ledger. When the governance names a secret collection the secret is kept there, under
+// the pseudonym, until the pseudonym is retired. Returns the pseudonym.
+// ========================================================================================
+// pseudonym, empty to derive it from the transient patient_id and secret
+var registerPseudonymArgs = []argSpec{
+	{"pseudonym", argText, false, ""},
+}
+
+func (t *SimpleChaincode) registerPseudonym(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	pn := strings.ToLower(p["pseudonym"])
+	var secret []byte
+	if len(pn) <= 0 {
+		transient, err := stub.GetTransient()
+		if err != nil {
+			return errorResponse(newError(errInternal, "Failed to get transient data: %s", err.Error()))
+		}
+		secret = transient["secret"]
+		p_id := strings.ToLower(string(transient["patient_id"]))
+		if len(secret) == 0 || len(p_id) <= 0 {
+			return errorResponse(newError(errInvalidArgument, "Either pseudonym or the transient patient_id and secret must be given"))
+		}
+		pn = keyedHash(secret, p_id)
+	} else if _, err := hex.DecodeString(pn); err != nil || len(pn) != 2*sha256.Size {
+		return errorResponse(newError(errInvalidArgument, "pseudonym must be a hex HMAC-SHA256"))
+	}
+	record, err := getPseudonym(stub, pn)
+	if err != nil {
+		return errorResponse(err)
+	} else if record != nil {
+		return errorResponse(newError(errConflict, "Pseudonym is already registered (%s)", record.Status))
+	}
+	if secret != nil {
+		gov, err := getGovernance(stub)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if len(gov.SecretCollection) > 0 {
+			err = stub.PutPrivateData(gov.SecretCollection, "secret_"+pn, secret)
+			if err != nil {
+				return errorResponse(newError(errInternal, "Failed to store secret: %s", err.Error()))
+			}
+		}
+	}
+	err = putPseudonym(stub, &pseudonym{"pseudonym", pn, "active"})
+	if err != nil {
+		return errorResponse(err)
+	}
+	pnJSONasBytes, _ := json.Marshal(map[string]string{"pseudonym": pn})
+	return shim.Success(pnJSONasBytes)
+}
+
+// ===== retirePseudonym ==================================================================
+// retirePseudonym stops a pseudonym from receiving consent and destroys its secret in the
+// secret collection. The pseudonym's consents have to be withdrawn first.
+// ========================================================================================
+var retirePseudonymArgs = []argSpec{
+	{"pseudonym", argText, true, ""},
+}
+
+func (t *SimpleChaincode) retirePseudonym(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	pn, err := resolvePatient(stub, p["pseudonym"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	record, err := getPseudonym(stub, pn)
+	if err != nil {
+		return errorResponse(err)
+	} else if record == nil {
+		return errorResponse(newError(errNotFound, "Pseudonym is not registered: %s", pn))
+	} else if record.Status != "active" {
+		return errorResponse(newError(errConflict, "Pseudonym is already retired"))
+	}
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := patientKey(stub, pn)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := store.byPartialCompositeKey(patientIndex, []string{key})
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to read patient index: %s", err.Error()))
+	}
+	held := resultsIterator.HasNext()
+	resultsIterator.Close()
+	if held {
+		return errorResponse(newError(errConflict, "Pseudonym still holds consents, withdraw them first"))
+	}
+	gov, err := getGovernance(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(gov.SecretCollection) > 0 {
+		err = stub.DelPrivateData(gov.SecretCollection, "secret_"+pn)
+		if err != nil {
+			return errorResponse(newError(errInternal, "Failed to delete secret: %s", err.Error()))
+		}
+	}
+	record.Status = "retired"
+	err = putPseudonym(stub, record)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+// accessStep is one step of the access evaluation.
+type accessStep struct {
+	Step   string `json:"step"`
+	Passed bool   `json:"passed"`
+	Code   string `json:"code,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// accessTrace records every step taken to decide an access request. Columns holds the
+// number of consented patients found for each requested column.
+type accessTrace struct {
+	RoleID      string              `json:"r_id"`
+	StartDate   string              `json:"s_date"`
+	EndDate     string              `json:"e_date"`
+	WatchdogID  string              `json:"w_id"`
+	Steps       []accessStep        `json:"steps"`
+	Columns     map[string]int      `json:"columns"`
+	Patients    map[string][]string `json:"patients,omitempty"`    // consenting patients per column, as stored, when granted
+	Certificate *accessCertificate  `json:"certificate,omitempty"` // issued by accessConsent
+	Granted     bool                `json:"granted"`
+	Code        string              `json:"code,omitempty"`
+	Reason      string              `json:"reason,omitempty"`
+}
+
+// pass appends a step that succeeded.
+func (trace *accessTrace) pass(name string, detail string) {
+	trace.Steps = append(trace.Steps, accessStep{Step: name, Passed: true, Detail: detail})
+}
+
+// fail appends a step that failed. The first failing step gives the reason for denial.
+func (trace *accessTrace) fail(name string, err error) {
+	trace.Steps = append(trace.Steps, accessStep{Step: name, Passed: false, Code: errorCode(err), Detail: err.Error()})
+	if trace.Reason == "" {
+		trace.Code = errorCode(err)
+		trace.Reason = err.Error()
+	}
+}
+
+// err returns the reason for denial as an error.
+func (trace *accessTrace) err() error {
+	return newError(trace.Code, "%s", trace.Reason)
+}
+
+// validDate reports whether s is a date in the YYYYMMDD form used in consent keys.
+func validDate(s string) bool {
+	_, err := time.Parse("20060102", s)
+	return err == nil
+}
+
+// checkWindow returns an error unless the start date is valid and the end date is either
+// empty or a valid date that does not come before the start date.
+func checkWindow(s_date string, e_date string) error {
+	if !validDate(s_date) {
+		return newError(errInvalidArgument, "Start date %s is not a YYYYMMDD date", s_date)
+	}
+	if e_date != "" && !validDate(e_date) {
+		return newError(errInvalidArgument, "End date %s is not a YYYYMMDD date", e_date)
+	}
+	if e_date != "" && e_date < s_date {
+		return newError(errInvalidArgument, "End date %s is before start date %s", e_date, s_date)
+	}
+	return nil
+}
+
+// evaluateAccess walks every step of an access request, even after one fails, so the
+// trace can explain all the reasons for a denial. An error is only returned when the
+// state cannot be read.
+func evaluateAccess(stub shim.ChaincodeStubInterface, r_id string, s_date string, e_date string, c_ids []string, acctype_id string) (*accessTrace, error) {
+	trace := &accessTrace{RoleID: r_id, StartDate: s_date, EndDate: e_date, WatchdogID: acctype_id, Columns: make(map[string]int), Patients: make(map[string][]string)}
+
+	_, err := governedWatchdog(stub, acctype_id, r_id)
+	if err != nil {
+		trace.fail("watchdog_registered", err)
+	} else {
+		trace.pass("watchdog_registered", "Watchdog "+acctype_id+" is registered and governs role "+r_id)
+	}
+
+	today, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkWindow(s_date, e_date)
+	if err != nil {
+		trace.fail("window_valid", err)
+	} else if e_date != "" && e_date < today {
+		// the consents of the window lapsed but may not have been swept yet
+		trace.fail("window_valid", newError(errExpired, "Consent window ended on %s", e_date))
+	} else {
+		trace.pass("window_valid", "Window "+s_date+" to "+e_date+" is valid")
+	}
+
+	for _, c_id := range c_ids {
+		trace.Columns[c_id] = 0
+	}
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return nil, err
+	}
+	// the patients with a record for the setting, as listed by the setting index
+	resultsIterator, err := store.byPartialCompositeKey(settingIndex, []string{r_id, s_date, e_date, acctype_id})
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get consent records: %s", err.Error())
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil || len(attributes) != 5 {
+			return nil, newError(errInternal, "Invalid setting index entry %s", responseRange.Key)
+		}
+		u_id := attributes[4]
+		marbleAsBytes, err := store.get(u_id + r_id + s_date + e_date + acctype_id)
+		if err != nil {
+			return nil, newError(errInternal, "Failed to get consent: %s", err.Error())
+		} else if marbleAsBytes == nil {
+			continue
+		}
+		marbleToTransfer := marble{}
+		err = json.Unmarshal(marbleAsBytes, &marbleToTransfer) //unmarshal it aka JSON.parse()
+		if err != nil {
+			return nil, err
+		}
+		// only active consents give access
+		if marbleToTransfer.state() == stateActive {
+			matching_cids := Hash(c_ids, marbleToTransfer.ColumnIDs)
+			for _, c_id := range matching_cids {
+				trace.Columns[c_id] = trace.Columns[c_id] + 1
+				trace.Patients[c_id] = append(trace.Patients[c_id], u_id)
+			}
+		}
+	}
+	count := 0
+	for _, c_id := range c_ids {
+		if trace.Columns[c_id] > 0 {
+			count = count + 1
+		}
+	}
+	if count == 0 {
+		// no consent certificate can be given
+		trace.fail("column_consent", newError(errNotFound, "Consent not found"))
+	} else {
+		trace.pass("column_consent", fmt.Sprintf("Consent found for %d of %d columns", count, len(c_ids)))
+	}
+
+	trace.Granted = trace.Reason == ""
+	if !trace.Granted {
+		// a denied request learns nothing about who consents
+		trace.Patients = nil
+	}
+	return trace, nil
+}
+
+// role id, start date, end date, column ids, watchdog id
+var accessConsentArgs = []argSpec{
+	{"role_id", argText, true, ""},
+	{"start_date", argText, true, ""},
+	{"end_date", argText, true, ""},
+	{"column_ids", argList, true, ""},
+	{"watchdog_id", argText, true, ""},
+}
+
+// ============================================================
+// accessConsent - check the consent given for a role and columns
+// ============================================================
+func (t *SimpleChaincode) accessConsent(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	trace, err := evaluateAccess(stub, strings.ToLower(p["role_id"]), strings.ToLower(p["start_date"]), strings.ToLower(p["end_date"]),
+		p.list("column_ids"), strings.ToLower(p["watchdog_id"]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	if !trace.Granted {
+		return errorResponse(trace.err())
+	}
+	trace.Certificate, err = issueAccessCertificate(stub, trace)
+	if err != nil {
+		return errorResponse(err)
+	}
+	traceJSONasBytes, err := json.Marshal(trace)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(traceJSONasBytes)
+}
+
+// accessCertificate is issued by accessConsent when access is granted. It names the
+// consented columns and commits to the patients consenting to each with the SHA-256 of
+// their sorted ids (as stored), so the custodian can release exactly that data. It is kept
+// under its id, the transaction id, and checked with verifyAccessCertificate.
+type accessCertificate struct {
+	ObjectType     string   `json:"docType"`
+	CertificateID  string   `json:"certificate_id"`
+	Holder         string   `json:"holder"` // client id of the caller of accessConsent
+	RoleID         string   `json:"r_id"`
+	WatchdogID     string   `json:"w_id"`
+	ColumnIDs      []string `json:"c_ids"`
+	PatientSetHash string   `json:"patient_set_hash"`
+	ValidFrom      string   `json:"valid_from"`
+	ValidUntil     string   `json:"valid_until"`
+	IssuedAt       string   `json:"issued_at"`
+}
+
+// certificateKey is the key a certificate is kept under.
+func certificateKey(stub shim.ChaincodeStubInterface, certificateID string) (string, error) {
+	return stub.CreateCompositeKey("accessCertificate", []string{certificateID})
+}
+
+// patientSetHash returns the consented columns of a granted trace and the hash of the
+// patients consenting to each.
+func patientSetHash(trace *accessTrace) ([]string, string) {
+	var c_ids []string
+	patients := make(map[string][]string)
+	for c_id, count := range trace.Columns {
+		if count > 0 {
+			c_ids = append(c_ids, c_id)
+			patients[c_id] = append([]string{}, trace.Patients[c_id]...)
+			sort.Strings(patients[c_id])
+		}
+	}
+	sort.Strings(c_ids)
+	// encoding/json writes map keys in sorted order
+	patientsJSONasBytes, _ := json.Marshal(patients)
+	sum := sha256.Sum256(patientsJSONasBytes)
+	return c_ids, hex.EncodeToString(sum[:])
+}
+
+// issueAccessCertificate stores the certificate for a granted trace.
+func issueAccessCertificate(stub shim.ChaincodeStubInterface, trace *accessTrace) (*accessCertificate, error) {
+	holder, err := cid.GetID(stub)
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get client id: %s", err.Error())
+	}
+	txTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get transaction time: %s", err.Error())
+	}
+	c_ids, hash := patientSetHash(trace)
+	certificate := &accessCertificate{ObjectType: "accessCertificate", CertificateID: stub.GetTxID(), Holder: holder,
+		RoleID: trace.RoleID, WatchdogID: trace.WatchdogID, ColumnIDs: c_ids, PatientSetHash: hash,
+		ValidFrom: trace.StartDate, ValidUntil: trace.EndDate,
+		IssuedAt: time.Unix(txTime.GetSeconds(), int64(txTime.GetNanos())).UTC().Format(time.RFC3339Nano)}
+	certificateJSONasBytes, err := json.Marshal(certificate)
+	if err != nil {
+		return nil, err
+	}
+	key, err := certificateKey(stub, certificate.CertificateID)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, certificateJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+// certificateCheck is the outcome of verifyAccessCertificate.
+type certificateCheck struct {
+	Match   bool `json:"match"`   // the certificate was issued as shown
+	Expired bool `json:"expired"` // its window ended before this transaction
+	Current bool `json:"current"` // the same patients still consent to the same columns
+}
+
+// ===== verifyAccessCertificate ==========================================================
+// verifyAccessCertificate lets the custodian check a certificate shown by a data consumer
+// before releasing data: that it was issued as shown, that its window has not ended, and
+// that access evaluated now would still cover the same patients and columns. The
+// certificate is rejected unless it is shown by its holder: the custodian names the
+// client id of the consumer showing it as presenter, while a consumer can only check its
+// own certificates.
+// ========================================================================================
+// certificate JSON, presenter client id
+var verifyAccessCertificateArgs = []argSpec{
+	{"certificate", argText, true, ""},
+	{"presenter", argText, false, ""},
+}
+
+// checkPresenter fails unless the certificate is shown by the client it was issued to.
+func checkPresenter(stub shim.ChaincodeStubInterface, holder string, presenter string) error {
+	err := authorize(stub, []roleGrant{asCustodian, asAdmin})
+	if err != nil && errorCode(err) != errUnauthorized {
+		return err
+	} else if err != nil {
+		// a data consumer shows its own certificate
+		caller, err := cid.GetID(stub)
+		if err != nil {
+			return newError(errInternal, "Failed to get client id: %s", err.Error())
+		} else if len(presenter) > 0 && presenter != caller {
+			return newError(errUnauthorized, "A data consumer can only present its own certificates")
+		}
+		presenter = caller
+	} else if len(presenter) <= 0 {
+		return newError(errInvalidArgument, "presenter must be the client id of the data consumer showing the certificate")
+	}
+	if presenter != holder {
+		return newError(errUnauthorized, "The certificate was issued to another client")
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) verifyAccessCertificate(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	var certificate accessCertificate
+	err := json.Unmarshal([]byte(p["certificate"]), &certificate)
+	if err != nil || len(certificate.CertificateID) <= 0 {
+		return errorResponse(newError(errInvalidArgument, "certificate must be an access certificate issued by accessConsent"))
+	}
+	key, err := certificateKey(stub, certificate.CertificateID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	storedAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to get certificate: %s", err.Error()))
+	} else if storedAsBytes == nil {
+		return errorResponse(newError(errNotFound, "No access certificate %s was issued", certificate.CertificateID))
+	}
+	var stored accessCertificate
+	err = json.Unmarshal(storedAsBytes, &stored)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = checkPresenter(stub, stored.Holder, p["presenter"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	// compare as re-encoded, so that the certificate may have been reformatted
+	certificateJSONasBytes, err := json.Marshal(certificate)
+	if err != nil {
+		return errorResponse(err)
+	}
+	check := certificateCheck{Match: bytes.Equal(certificateJSONasBytes, storedAsBytes)}
+	today, err := txDate(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	check.Expired = len(certificate.ValidUntil) > 0 && today > certificate.ValidUntil
+	trace, err := evaluateAccess(stub, certificate.RoleID, certificate.ValidFrom, certificate.ValidUntil, certificate.ColumnIDs,
+		certificate.WatchdogID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if trace.Granted {
+		c_ids, hash := patientSetHash(trace)
+		check.Current = strings.Join(c_ids, ",") == strings.Join(certificate.ColumnIDs, ",") && hash == certificate.PatientSetHash
+	}
+	checkJSONasBytes, _ := json.Marshal(check)
+	return shim.Success(checkJSONasBytes)
+}
+
+// ===== explainAccess ====================================================================
+// explainAccess takes the same arguments as accessConsent and returns the trace of every
+// evaluation step instead of failing, so a denial can be diagnosed.
+// ========================================================================================
+func (t *SimpleChaincode) explainAccess(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	trace, err := evaluateAccess(stub, strings.ToLower(p["role_id"]), strings.ToLower(p["start_date"]), strings.ToLower(p["end_date"]),
+		p.list("column_ids"), strings.ToLower(p["watchdog_id"]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	// the consenting patients are only released by accessConsent, which logs the access
+	err = authorize(stub, []roleGrant{asCustodian, asAdmin})
+	if err != nil && errorCode(err) != errUnauthorized {
+		return errorResponse(err)
+	} else if err != nil {
+		trace.Patients = nil
+	}
+	traceJSONasBytes, err := json.Marshal(trace)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(traceJSONasBytes)
+}
+
+func Hash(a interface{}, b interface{}) []string {
+	set := make([]string, 0)
+	hash := make(map[string]bool)
+	av := reflect.ValueOf(a)
+	bv := reflect.ValueOf(b)
+
+	for i := 0; i < av.Len(); i++ {
+		el := av.Index(i).Interface()
+		hash[fmt.Sprintf("%v", el)] = true
+	}
+
+	for i := 0; i < bv.Len(); i++ {
+		el := bv.Index(i).Interface()
+		if _, found := hash[fmt.Sprintf("%v", el)]; found {
+			set = append(set, fmt.Sprintf("%v", el))
+		}
+	}
+
+	return set
+}
+
+
+func contains(s []string, e string) int {
+    for i, a := range s {
+        if a == e {
+            return i
+        }
+    }
+    return -1
+}
+
+func remove(s []string, i int) []string {
+    s[i] = s[len(s)-1]
+    // We do not need to put s[i] at the end, as it will be discarded anyway
+    return s[:len(s)-1]
+}
+
+// Consent lifecycle states. A grant makes a consent active, or pending when it is only
+// proposed (action "p") for the patient to grant; setConsentState moves it on from there.
+// Only active consents give access. Consents stored before states existed are active.
+const (
+	stateActive    = 1
+	statePending   = 2
+	stateSuspended = 3
+	stateExpired   = 4
+	stateWithdrawn = 5
+)
+
+var stateNames = map[int]string{stateActive: "active", statePending: "pending", stateSuspended: "suspended",
+	stateExpired: "expired", stateWithdrawn: "withdrawn"}
+
+// transitions lists the states setConsentState may move each state to. A pending consent
+// only becomes active when the patient grants it with updateConsent, and expired or
+// withdrawn consents have to be granted anew.
+var transitions = map[int][]int{
+	statePending:   {stateWithdrawn},
+	stateActive:    {stateSuspended, stateExpired, stateWithdrawn},
+	stateSuspended: {stateActive, stateExpired, stateWithdrawn},
+}
+
+func parseState(name string) (int, error) {
+	for state, stateName := range stateNames {
+		if stateName == strings.ToLower(name) {
+			return state, nil
+		}
+	}
+	return 0, newError(errInvalidArgument, "state must be one of pending, active, suspended, expired or withdrawn")
+}
+
+// checkTransition fails unless setConsentState may move a consent from one state to the
+// other. Patients may neither suspend their consents nor lift a suspension.
+func checkTransition(stub shim.ChaincodeStubInterface, from int, to int) error {
+	allowed := false
+	for _, state := range transitions[from] {
+		allowed = allowed || state == to
+	}
+	if !allowed {
+		return newError(errConflict, "A %s consent cannot become %s", stateNames[from], stateNames[to])
+	}
+	if from != stateSuspended && to != stateSuspended {
+		return nil
+	}
+	caller, found, err := cid.GetAttributeValue(stub, "consentio.patient_id")
+	if err != nil {
+		return newError(errInternal, "Failed to get client patient id: %s", err.Error())
+	} else if found && len(caller) > 0 {
+		return newError(errUnauthorized, "Only the custodian may suspend a consent or lift a suspension")
+	}
+	return nil
+}
+
+// grantedState returns the state a grant ("g") or proposal ("p") leaves a consent in
+// (0 when there is none) and whether that changes it. A suspended consent stays
+// suspended.
+func grantedState(current int, action string) (int, bool) {
+	switch {
+	case current == 0 || current == stateExpired || current == stateWithdrawn:
+		if action == "p" {
+			return statePending, true
+		}
+		return stateActive, true
+	case current == statePending && action == "g":
+		return stateActive, true
+	}
+	return current, false
+}
+
+// consentOp is a single grant ("g"), proposal ("p") or revoke ("r") of a patient's
+// consent on a set of columns, as taken by updateConsent and by each item of
+// bulkUpdateConsent.
+type consentOp struct {
+	PatientID  string   `json:"patient_id"`
+	Action     string   `json:"action"`
+	RoleID     string   `json:"role_id"`
+	StartDate  string   `json:"start_date"`
+	EndDate    string   `json:"end_date"`
+	ColumnIDs  []string `json:"column_ids"`
+	WatchdogID string   `json:"watchdog_id"`
+	Signature  string   `json:"signature,omitempty"` // by the patient's registered key, if any
+	Nonce      string   `json:"nonce,omitempty"`
+}
+
+// validate normalises the operation and checks it can be applied in the batch.
+func (op *consentOp) validate(stub shim.ChaincodeStubInterface, batch *consentBatch) error {
+	op.PatientID = strings.ToLower(op.PatientID)
+	op.Action = strings.ToLower(op.Action)
+	op.RoleID = strings.ToLower(op.RoleID)
+	op.StartDate = strings.ToLower(op.StartDate)
+	op.EndDate = strings.ToLower(op.EndDate)
+	op.WatchdogID = strings.ToLower(op.WatchdogID)
+	// a patient may only update its own consent
+	p_id, err := resolvePatient(stub, op.PatientID)
+	if err != nil {
+		return err
+	}
+	op.PatientID = p_id
+	if op.Action != "g" && op.Action != "p" && op.Action != "r" {
+		return newError(errInvalidArgument, "action must be g, p or r")
+	}
+	if len(op.RoleID) <= 0 {
+		return newError(errInvalidArgument, "role_id must be a non-empty string")
+	}
+	if len(op.StartDate) <= 0 {
+		return newError(errInvalidArgument, "start_date must be a non-empty string")
+	}
+	err = checkWindow(op.StartDate, op.EndDate)
+	if err != nil {
+		return err
+	}
+	if len(op.ColumnIDs) == 0 {
+		return newError(errInvalidArgument, "column_ids must not be empty")
+	}
+	for _, c_id := range op.ColumnIDs {
+		if len(c_id) <= 0 {
+			return newError(errInvalidArgument, "column_ids must be non-empty strings")
+		}
+	}
+	if op.Action != "r" {
+		err = checkPatient(stub, op.PatientID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = governedWatchdog(stub, op.WatchdogID, op.RoleID)
+	if err != nil {
+		return err
+	}
+	p_key, err := patientKey(stub, op.PatientID)
+	if err != nil {
+		return err
+	}
+	err = checkSignature(stub, batch, op, p_key)
+	if err != nil {
+		return err
+	}
+	// from here on the patient is identified as stored
+	op.PatientID = p_key
+	return nil
+}
+
+// consentStore reads and writes consent records and patient index entries. They are kept
+// in public state unless the governance names a consent collection; then they are kept in
+// that private data collection, readable only by its member organisations, and public
+// state holds the SHA-256 of each record under a hashed key so that other organisations
+// can still verify a record shown to them (verifyConsentRecord).
+type consentStore struct {
+	stub       shim.ChaincodeStubInterface
+	collection string
+}
+
+func newConsentStore(stub shim.ChaincodeStubInterface) (*consentStore, error) {
+	gov, err := getGovernance(stub)
+	if err != nil {
+		return nil, err
+	}
+	return &consentStore{stub, gov.ConsentCollection}, nil
+}
+
+// consentHashKey is the public key holding the hash of a private record.
+func consentHashKey(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	sum := sha256.Sum256([]byte(key))
+	return stub.CreateCompositeKey("consentHash", []string{hex.EncodeToString(sum[:])})
+}
+
+func (s *consentStore) get(key string) ([]byte, error) {
+	if len(s.collection) <= 0 {
+		return s.stub.GetState(key)
+	}
+	return s.stub.GetPrivateData(s.collection, key)
+}
+
+// put writes a record, and its hash when the record is private.
+func (s *consentStore) put(key string, value []byte) error {
+	if len(s.collection) <= 0 {
+		return s.stub.PutState(key, value)
+	}
+	err := s.stub.PutPrivateData(s.collection, key, value)
+	if err != nil {
+		return err
+	}
+	hashKey, err := consentHashKey(s.stub, key)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(value)
+	return s.stub.PutState(hashKey, []byte(hex.EncodeToString(sum[:])))
+}
+
+// del deletes a record, and its hash when the record is private.
+func (s *consentStore) del(key string) error {
+	if len(s.collection) <= 0 {
+		return s.stub.DelState(key)
+	}
+	err := s.stub.DelPrivateData(s.collection, key)
+	if err != nil {
+		return err
+	}
+	hashKey, err := consentHashKey(s.stub, key)
+	if err != nil {
+		return err
+	}
+	return s.stub.DelState(hashKey)
+}
+
+// setEntry writes (or deletes) an index entry, which has no hash.
+func (s *consentStore) setEntry(key string, present bool) error {
+	if len(s.collection) <= 0 {
+		if present {
+			return s.stub.PutState(key, []byte{0x00})
+		}
+		return s.stub.DelState(key)
+	}
+	if present {
+		return s.stub.PutPrivateData(s.collection, key, []byte{0x00})
+	}
+	return s.stub.DelPrivateData(s.collection, key)
+}
+
+func (s *consentStore) byPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	if len(s.collection) <= 0 {
+		return s.stub.GetStateByPartialCompositeKey(objectType, attributes)
+	}
+	return s.stub.GetPrivateDataByPartialCompositeKey(s.collection, objectType, attributes)
+}
+
+func (s *consentStore) query(queryString string) (shim.StateQueryIteratorInterface, error) {
+	if len(s.collection) <= 0 {
+		return s.stub.GetQueryResult(queryString)
+	}
+	return s.stub.GetPrivateDataQueryResult(s.collection, queryString)
+}
+
+// setExpiry writes an expiry index entry, or deletes it when entry is nil. The index is
+// kept with the consent records, as its keys name them.
+func (s *consentStore) setExpiry(indexKey string, entry *expiryEntry) error {
+	if entry == nil {
+		if len(s.collection) <= 0 {
+			return s.stub.DelState(indexKey)
+		}
+		return s.stub.DelPrivateData(s.collection, indexKey)
+	}
+	entryJSONasBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if len(s.collection) <= 0 {
+		return s.stub.PutState(indexKey, entryJSONasBytes)
+	}
+	return s.stub.PutPrivateData(s.collection, indexKey, entryJSONasBytes)
+}
+
+// ===== verifyConsentRecord ==============================================================
+// verifyConsentRecord tells whether a consent record, as shown by a member of the consent
+// collection, matches the hash kept in public state. Any organisation may call it.
+// ========================================================================================
+// consent key, record JSON exactly as stored
+var verifyConsentRecordArgs = []argSpec{
+	{"key", argText, true, ""},
+	{"record", argText, true, ""},
+}
+
+func (t *SimpleChaincode) verifyConsentRecord(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	hashKey, err := consentHashKey(stub, p["key"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	hashAsBytes, err := stub.GetState(hashKey)
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to get consent hash: %s", err.Error()))
+	} else if hashAsBytes == nil {
+		return errorResponse(newError(errNotFound, "No private consent is stored under this key"))
+	}
+	sum := sha256.Sum256([]byte(p["record"]))
+	resultJSONasBytes, _ := json.Marshal(map[string]bool{"match": string(hashAsBytes) == hex.EncodeToString(sum[:])})
+	return shim.Success(resultJSONasBytes)
+}
+
+// expiryEntry is the value of an expiry index entry. Every consent record with an end date
+// has an entry under the composite key expiry~<end date>~<record key>, kept with the
+// record, so that sweepExpired finds the lapsed records by reading the index in date
+// order.
+type expiryEntry struct {
+	Kind       string   `json:"kind"` // consent
+	Key        string   `json:"key"`
+	Attributes []string `json:"attributes,omitempty"` // patient index attributes of the consent
+}
+
+// Object type of the expiry index.
+const expiryIndex = "expiry"
+
+// txDate returns the date of the transaction as YYYYMMDD, in UTC.
+func txDate(stub shim.ChaincodeStubInterface) (string, error) {
+	txTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", newError(errInternal, "Failed to get transaction time: %s", err.Error())
+	}
+	return time.Unix(txTime.GetSeconds(), 0).UTC().Format("20060102"), nil
+}
+
+// consentBatch buffers consent records for the length of a transaction. Fabric does not
+// let a transaction read its own writes, so operations touching the same key have to see
+// each other's changes here before anything is written.
+// The patient index and expiry index entries the records imply are buffered with them.
+type consentBatch struct {
+	store       *consentStore
+	records     map[string]*marble // nil once deleted or if it never existed
+	dirty       []string
+	indexes     map[string]*indexEntry
+	indexOrder  []string
+	expiries    map[string]*expiryUpdate
+	expiryOrder []string
+	nonces      map[string]bool // nonce keys used earlier in the transaction, unseen by GetState
+}
+
+// indexEntry is an entry of the patient index to write, or to delete when not present.
+type indexEntry struct {
+	attributes []string
+	present    bool
+}
+
+// expiryUpdate is an entry of the expiry index to write, or to delete when entry is nil.
+type expiryUpdate struct {
+	attributes []string // end date, record key
+	entry      *expiryEntry
+}
+
+func newConsentBatch(store *consentStore) *consentBatch {
+	return &consentBatch{store: store, records: make(map[string]*marble), indexes: make(map[string]*indexEntry),
+		expiries: make(map[string]*expiryUpdate), nonces: make(map[string]bool)}
+}
+
+func (b *consentBatch) get(unq_id string) (*marble, error) {
+	if record, ok := b.records[unq_id]; ok {
+		return record, nil
+	}
+	marbleAsBytes, err := b.store.get(unq_id)
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get consent: %s", err.Error())
+	}
+	var record *marble
+	if marbleAsBytes != nil {
+		record = &marble{}
+		err = json.Unmarshal(marbleAsBytes, record) //unmarshal it aka JSON.parse()
+		if err != nil {
+			return nil, err
+		}
+		record.uniqueID = unq_id
+	}
+	b.records[unq_id] = record
+	return record, nil
+}
+
+func (b *consentBatch) put(unq_id string, record *marble) {
+	b.records[unq_id] = record
+	if contains(b.dirty, unq_id) == -1 {
+		b.dirty = append(b.dirty, unq_id)
+	}
+}
+
+func (b *consentBatch) del(unq_id string) {
+	b.put(unq_id, nil)
+}
+
+// index adds (or removes) the patient index entry with the given attributes.
+func (b *consentBatch) index(present bool, attributes ...string) {
+	id := strings.Join(attributes, "\x00")
+	if _, ok := b.indexes[id]; !ok {
+		b.indexOrder = append(b.indexOrder, id)
+	}
+	b.indexes[id] = &indexEntry{attributes, present}
+}
+
+// expire buffers the expiry index entry of a record, or its removal when entry is nil.
+// Records without an end date have none.
+func (b *consentBatch) expire(e_date string, key string, entry *expiryEntry) {
+	if len(e_date) > 0 {
+		b.setExpiry([]string{e_date, key}, entry)
+	}
+}
+
+func (b *consentBatch) setExpiry(attributes []string, entry *expiryEntry) {
+	id := strings.Join(attributes, "\x00")
+	if _, ok := b.expiries[id]; !ok {
+		b.expiryOrder = append(b.expiryOrder, id)
+	}
+	b.expiries[id] = &expiryUpdate{attributes, entry}
+}
+
+// flush writes every changed record, in the order they were first changed.
+func (b *consentBatch) flush() error {
+	for _, unq_id := range b.dirty {
+		record := b.records[unq_id]
+		if record == nil {
+			err := b.store.del(unq_id)
+			if err != nil {
+				return newError(errInternal, "Failed to delete state: %s", err.Error())
+			}
+			continue
+		}
+		marbleJSONasBytes, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		err = b.store.put(unq_id, marbleJSONasBytes)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range b.indexOrder {
+		entry := b.indexes[id]
+		indexKey, err := b.store.stub.CreateCompositeKey(patientIndex, entry.attributes)
+		if err != nil {
+			return newError(errInvalidArgument, "Invalid consent key: %s", err.Error())
+		}
+		err = b.store.setEntry(indexKey, entry.present)
+		if err != nil {
+			return newError(errInternal, "Failed to update patient index: %s", err.Error())
+		}
+		// the setting index has the same entries, led by the setting
+		setting := append(append([]string{}, entry.attributes[1:]...), entry.attributes[0])
+		indexKey, err = b.store.stub.CreateCompositeKey(settingIndex, setting)
+		if err != nil {
+			return newError(errInvalidArgument, "Invalid consent key: %s", err.Error())
+		}
+		err = b.store.setEntry(indexKey, entry.present)
+		if err != nil {
+			return newError(errInternal, "Failed to update setting index: %s", err.Error())
+		}
+	}
+	for _, id := range b.expiryOrder {
+		update := b.expiries[id]
+		indexKey, err := b.store.stub.CreateCompositeKey(expiryIndex, update.attributes)
+		if err != nil {
+			return newError(errInvalidArgument, "Invalid consent key: %s", err.Error())
+		}
+		err = b.store.setExpiry(indexKey, update.entry)
+		if err != nil {
+			return newError(errInternal, "Failed to update expiry index: %s", err.Error())
+		}
+	}
+	b.dirty = nil
+	b.indexes = make(map[string]*indexEntry)
+	b.indexOrder = nil
+	b.expiries = make(map[string]*expiryUpdate)
+	b.expiryOrder = nil
+	return nil
+}
+
+// consentExpiry is the expiry index entry of the patient's record.
+func consentExpiry(unq_id string, op *consentOp) *expiryEntry {
+	return &expiryEntry{"consent", unq_id, []string{op.PatientID, op.RoleID, op.StartDate, op.EndDate, op.WatchdogID}}
+}
+
+// applyConsent adds or removes the columns of the operation on the patient's record and
+// reports whether the set of columns changed. The state is kept per record, so a proposal
+// cannot add columns to an active or suspended one: they would take effect without the
+// patient granting them.
+func applyConsent(batch *consentBatch, op *consentOp) (bool, error) {
+	unq_id := op.PatientID + op.RoleID + op.StartDate + op.EndDate + op.WatchdogID
+	record, err := batch.get(unq_id)
+	if err != nil {
+		return false, err
+	} else if record != nil {
+		if op.Action == "p" && (record.state() == stateActive || record.state() == stateSuspended) {
+			for _, c_id := range op.ColumnIDs {
+				if contains(record.ColumnIDs, c_id) == -1 {
+					return false, newError(errConflict, "A %s consent cannot be extended by a proposal; grant column %s instead", stateNames[record.state()], c_id)
+				}
+			}
+		}
+		changedone := false
+		column_ids := record.ColumnIDs
+		if op.Action != "r" {
+			state, changed := grantedState(record.state(), op.Action)
+			if changed && (record.State == stateExpired || record.State == stateWithdrawn) {
+				// a new consent, the columns of the ended one do not carry over
+				column_ids = nil
+			}
+			if changed {
+				record.State = state
+				changedone = true
+			}
+		}
+		// for each column id check if it exists in the values for the key
+		for _, c_id := range op.ColumnIDs {
+			index := contains(column_ids, c_id)
+			if op.Action != "r" && index == -1 {
+				column_ids = append(column_ids, c_id)
+				changedone = true
+			} else if op.Action == "r" && index != -1 {
+				column_ids = remove(column_ids, index)
+				changedone = true
+			}
+		}
+		if !changedone {
+			// nothing to write, nor to log for auditing
+			return false, nil
+		} else if len(column_ids) == 0 {
+			// if there are no resource ids left, then delete that key-value pair
+			batch.del(unq_id)
+			batch.index(false, op.PatientID, op.RoleID, op.StartDate, op.EndDate, op.WatchdogID)
+			batch.expire(op.EndDate, unq_id, nil)
+		} else {
+			record.ColumnIDs = column_ids
+			batch.put(unq_id, record)
+			if op.Action != "r" {
+				// a sweep may have dropped the entry of a record it marked expired
+				batch.expire(op.EndDate, unq_id, consentExpiry(unq_id, op))
+			}
+		}
+		return changedone, nil
+	} else if op.Action != "r" {
+		// if a configuration does not exist create one
+		var column_ids []string
+		for _, c_id := range op.ColumnIDs {
+			if contains(column_ids, c_id) == -1 {
+				column_ids = append(column_ids, c_id)
+			}
+		}
+		state, _ := grantedState(0, op.Action)
+		batch.put(unq_id, &marble{unq_id, op.PatientID, op.RoleID, op.StartDate, op.EndDate, column_ids, op.WatchdogID, state})
+		batch.index(true, op.PatientID, op.RoleID, op.StartDate, op.EndDate, op.WatchdogID)
+		batch.expire(op.EndDate, unq_id, consentExpiry(unq_id, op))
+		return true, nil
+	}
+	return false, nil
+}
+
+//patient_id, action, role_id, start date, end date, arr[column ids], watchdog id, patient signature, nonce
+var updateConsentArgs = []argSpec{
+	{"patient_id", argText, true, ""},
+	{"action", argText, true, ""},
+	{"role_id", argText, true, ""},
+	{"start_date", argText, true, ""},
+	{"end_date", argText, false, ""},
+	{"column_ids", argList, true, ""},
+	{"watchdog_id", argText, true, ""},
+	{"signature", argText, false, ""},
+	{"nonce", argText, false, ""},
+}
+
+func (t *SimpleChaincode) updateConsent(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	// ==== Input sanitation ====
+	op := &consentOp{p["patient_id"], p["action"], p["role_id"], p["start_date"], p["end_date"], p.list("column_ids"), p["watchdog_id"], p["signature"], p["nonce"]}
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	batch := newConsentBatch(store)
+	err = op.validate(stub, batch)
+	if err != nil {
+		return errorResponse(err)
+	}
+	changed, err := applyConsent(batch, op)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = batch.flush()
+	if err != nil {
+		return errorResponse(err)
+	}
+	if op.Action != "g" || !changed {
+		// a grant that changes nothing was already given, and its receipt issued
+		return shim.Success(nil)
+	}
+	// a grant is made on the patient's behalf unless the patient submits it
+	caller, _, err := cid.GetAttributeValue(stub, "consentio.patient_id")
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to get client patient id: %s", err.Error()))
+	}
+	receiptJSONasBytes, err := issueConsentReceipt(stub, op, strings.ToLower(caller) != strings.ToLower(p["patient_id"]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(receiptJSONasBytes)
+}
+
+// consentReceipt records a grant in the structure of the Kantara Initiative Consent
+// Receipt Specification (v1.1). The patient is the PII principal, the organisation that
+// submitted the grant its PII controller, the watchdog the service, the role the purpose
+// and the columns its PII categories. Only the SHA-256 of the receipt is kept on the
+// ledger, under its id (the transaction id), so that it can later be checked with
+// verifyConsentReceipt.
+type consentReceipt struct {
+	Version          string              `json:"version"`
+	ConsentReceiptID string              `json:"consentReceiptID"`
+	ConsentTimestamp int64               `json:"consentTimestamp"`
+	CollectionMethod string              `json:"collectionMethod"`
+	PiiPrincipalID   string              `json:"piiPrincipalId"` // patient id, as stored
+	PiiControllers   []receiptController `json:"piiControllers"`
+	Services         []receiptService    `json:"services"`
+	Sensitive        bool                `json:"sensitive"`
+}
+
+type receiptController struct {
+	PiiController string `json:"piiController"` // MSP id
+	OnBehalf      bool   `json:"onBehalf"`
+}
+
+type receiptService struct {
+	Service  string           `json:"service"`
+	Purposes []receiptPurpose `json:"purposes"`
+}
+
+type receiptPurpose struct {
+	Purpose              string   `json:"purpose"`
+	ConsentType          string   `json:"consentType"`
+	PiiCategory          []string `json:"piiCategory"`
+	PrimaryPurpose       bool     `json:"primaryPurpose"`
+	Termination          string   `json:"termination"`
+	ThirdPartyDisclosure bool     `json:"thirdPartyDisclosure"`
+}
+
+// consentReceiptKey is the key holding the hash of a receipt.
+func consentReceiptKey(stub shim.ChaincodeStubInterface, receiptID string) (string, error) {
+	return stub.CreateCompositeKey("consentReceipt", []string{receiptID})
+}
+
+// issueConsentReceipt builds the receipt of a validated grant and stores its hash.
+func issueConsentReceipt(stub shim.ChaincodeStubInterface, op *consentOp, onBehalf bool) ([]byte, error) {
+	msp_id, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get client MSP id: %s", err.Error())
+	}
+	txTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, newError(errInternal, "Failed to get transaction time: %s", err.Error())
+	}
+	termination := "from " + op.StartDate + " until withdrawn"
+	if len(op.EndDate) > 0 {
+		termination = "from " + op.StartDate + " until " + op.EndDate
+	}
+	receipt := &consentReceipt{"KI-CR-v1.1.0", stub.GetTxID(), txTime.GetSeconds(), "updateConsent", op.PatientID,
+		[]receiptController{{msp_id, onBehalf}},
+		[]receiptService{{op.WatchdogID, []receiptPurpose{{op.RoleID, "EXPLICIT", op.ColumnIDs, true, termination, true}}}},
+		true}
+	receiptJSONasBytes, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+	receiptKey, err := consentReceiptKey(stub, receipt.ConsentReceiptID)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(receiptJSONasBytes)
+	err = stub.PutState(receiptKey, []byte(hex.EncodeToString(sum[:])))
+	if err != nil {
+		return nil, err
+	}
+	return receiptJSONasBytes, nil
+}
+
+// ===== verifyConsentReceipt =============================================================
+// verifyConsentReceipt tells whether a consent receipt, exactly as returned by
+// updateConsent, matches the hash recorded for it. Any organisation may call it.
+// ========================================================================================
+// receipt JSON
+var verifyConsentReceiptArgs = []argSpec{
+	{"receipt", argText, true, ""},
+}
+
+func (t *SimpleChaincode) verifyConsentReceipt(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	var receipt consentReceipt
+	err := json.Unmarshal([]byte(p["receipt"]), &receipt)
+	if err != nil || len(receipt.ConsentReceiptID) <= 0 {
+		return errorResponse(newError(errInvalidArgument, "receipt must be a consent receipt issued by updateConsent"))
+	}
+	receiptKey, err := consentReceiptKey(stub, receipt.ConsentReceiptID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	hashAsBytes, err := stub.GetState(receiptKey)
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to get receipt hash: %s", err.Error()))
+	} else if hashAsBytes == nil {
+		return errorResponse(newError(errNotFound, "No consent receipt %s was issued", receipt.ConsentReceiptID))
+	}
+	sum := sha256.Sum256([]byte(p["receipt"]))
+	resultJSONasBytes, _ := json.Marshal(map[string]bool{"match": string(hashAsBytes) == hex.EncodeToString(sum[:])})
+	return shim.Success(resultJSONasBytes)
+}
+
+// bulkResult is the outcome of one item of bulkUpdateConsent.
+type bulkResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"` // applied, unchanged, invalid or skipped
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type bulkReport struct {
+	Mode      string       `json:"mode"`
+	Applied   int          `json:"applied"`
+	Unchanged int          `json:"unchanged"`
+	Invalid   int          `json:"invalid"`
+	Results   []bulkResult `json:"results"`
+}
+
+// ===== bulkUpdateConsent ================================================================
+// bulkUpdateConsent applies a JSON array of consentOp in one transaction.
+// In "atomic" mode (the default) nothing is written if any item is invalid and the report
+// is returned as the error message. In "per-item" mode invalid items are skipped and the
+// others applied. Either way the whole transaction fails if the state cannot be read or written.
+// ========================================================================================
+// arr[consent operations] as JSON, mode
+var bulkUpdateConsentArgs = []argSpec{
+	{"operations", argJSON, true, ""},
+	{"mode", argText, false, "atomic"},
+}
+
+func (t *SimpleChaincode) bulkUpdateConsent(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	mode := strings.ToLower(p["mode"])
+	if mode != "atomic" && mode != "per-item" {
+		return errorResponse(newError(errInvalidArgument, "mode must be atomic or per-item"))
+	}
+	var ops []*consentOp
+	err := json.Unmarshal([]byte(p["operations"]), &ops)
+	if err != nil {
+		return errorResponse(newError(errInvalidArgument, "operations must be a JSON array of consent operations: %s", err.Error()))
+	}
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	batch := newConsentBatch(store)
+	report := bulkReport{Mode: mode, Results: make([]bulkResult, len(ops))}
+	for i, op := range ops {
+		report.Results[i].Index = i
+		if op == nil {
+			op = &consentOp{}
+			ops[i] = op
+		}
+		err := op.validate(stub, batch)
+		if err != nil {
+			report.Results[i].Status = "invalid"
+			report.Results[i].Code = errorCode(err)
+			report.Results[i].Error = err.Error()
+			report.Invalid++
+		}
+	}
+	if mode == "atomic" && report.Invalid > 0 {
+		for i := range report.Results {
+			if report.Results[i].Status == "" {
+				report.Results[i].Status = "skipped"
+			}
+		}
+		return errorResponse(&chaincodeError{Code: errInvalidArgument, Message: fmt.Sprintf("%d of %d consent operations are invalid", report.Invalid, len(ops)), Details: report})
+	}
+	for i, op := range ops {
+		if report.Results[i].Status == "invalid" {
+			continue
+		}
+		changed, err := applyConsent(batch, op)
+		if err != nil && errorCode(err) != errConflict {
+			return errorResponse(err)
+		} else if err != nil {
+			// a proposal the earlier items made conflict
+			report.Results[i].Status = "invalid"
+			report.Results[i].Code = errorCode(err)
+			report.Results[i].Error = err.Error()
+			report.Invalid++
+			if mode == "atomic" {
+				report.Applied, report.Unchanged = 0, 0
+				for j := range report.Results {
+					if report.Results[j].Status == "" || j < i {
+						report.Results[j].Status = "skipped"
+					}
+				}
+				return errorResponse(&chaincodeError{Code: errInvalidArgument, Message: fmt.Sprintf("%d of %d consent operations are invalid", report.Invalid, len(ops)), Details: report})
+			}
+		} else if changed {
+			report.Results[i].Status = "applied"
+			report.Applied++
+		} else {
+			report.Results[i].Status = "unchanged"
+			report.Unchanged++
+		}
+	}
+	err = batch.flush()
+	if err != nil {
+		return errorResponse(err)
+	}
+	reportJSONasBytes, err := json.Marshal(report)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(reportJSONasBytes)
+}
+
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
+	// buffer is a JSON array containing QueryResults
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		// Add a comma before array members, suppress it for the first array member
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(queryResponse.Key)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Record\":")
+		// Record is a JSON object, so we write as-is
+		buffer.WriteString(string(queryResponse.Value))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return &buffer, nil
+}
+
+// historyEntry is the set of columns a patient consents to for a setting after one
+// transaction.
+type historyEntry struct {
+	TxID      string   `json:"tx_id"`
+	Timestamp string   `json:"timestamp"`
+	ColumnIDs []string `json:"column_ids"`
+}
+
+// keyChange is one modification of a key read from the history database. value is nil
+// when the key was deleted.
+type keyChange struct {
+	key       string
+	txID      string
+	timestamp time.Time
+	value     []byte
+}
+
+// getKeyHistory returns the modifications of all the keys, oldest first. The history of
+// private consents is not available.
+func getKeyHistory(stub shim.ChaincodeStubInterface, keys []string) ([]keyChange, error) {
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return nil, err
+	} else if len(store.collection) > 0 {
+		return nil, newError(errInvalidArgument, "Consent history is not available for consents kept in a private data collection")
+	}
+	var changes []keyChange
+	for _, key := range keys {
+		resultsIterator, err := stub.GetHistoryForKey(key)
+		if err != nil {
+			return nil, newError(errInternal, "Failed to get history: %s", err.Error())
+		}
+		for resultsIterator.HasNext() {
+			modification, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, newError(errInternal, "Failed to get history: %s", err.Error())
+			}
+			change := keyChange{key: key, txID: modification.TxId}
+			change.timestamp = time.Unix(modification.Timestamp.GetSeconds(), int64(modification.Timestamp.GetNanos())).UTC()
+			if !modification.IsDelete {
+				change.value = modification.Value
+			}
+			changes = append(changes, change)
+		}
+		resultsIterator.Close()
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].timestamp.Before(changes[j].timestamp) })
+	return changes, nil
+}
+
+// appendHistory adds an entry for the transaction unless the consented columns are the
+// same as after the previous entry.
+func appendHistory(history []historyEntry, change keyChange, c_ids []string) []historyEntry {
+	previous := []string{}
+	if len(history) > 0 {
+		previous = history[len(history)-1].ColumnIDs
+	}
+	if strings.Join(previous, ",") == strings.Join(c_ids, ",") {
+		return history
+	}
+	return append(history, historyEntry{change.txID, change.timestamp.Format(time.RFC3339Nano), c_ids})
+}
+
+// ===== getConsentHistory ================================================================
+// getConsentHistory returns, oldest first, every transaction that changed the columns a
+// patient consents to for a setting, optionally only looking at some columns. It needs
+// the peer's history database (core.ledger.history.enableHistoryDatabase).
+// ========================================================================================
+// patient id, role id, start date, end date, watchdog id, column ids
+var getConsentHistoryArgs = []argSpec{
+	{"patient_id", argText, true, ""},
+	{"role_id", argText, true, ""},
+	{"start_date", argText, true, ""},
+	{"end_date", argText, false, ""},
+	{"watchdog_id", argText, true, ""},
+	{"column_ids", argList, false, ""},
+}
+
+func (t *SimpleChaincode) getConsentHistory(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	p_id, err := resolvePatient(stub, p["patient_id"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	p_id, err = patientKey(stub, p_id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	unq_id := p_id + strings.ToLower(p["role_id"]) + strings.ToLower(p["start_date"]) +
+		strings.ToLower(p["end_date"]) + strings.ToLower(p["watchdog_id"])
+	c_ids := p.list("column_ids")
+	changes, err := getKeyHistory(stub, []string{unq_id})
+	if err != nil {
+		return errorResponse(err)
+	}
+	history := []historyEntry{}
+	for _, change := range changes {
+		// the record is rewritten even when no column changes
+		current := []string{}
+		if change.value != nil {
+			record := marble{}
+			err = json.Unmarshal(change.value, &record)
+			if err != nil {
+				return errorResponse(err)
+			}
+			if record.state() != stateActive {
+				record.ColumnIDs = nil
+			}
+			for _, c_id := range record.ColumnIDs {
+				if len(c_ids) == 0 || contains(c_ids, c_id) != -1 {
+					current = append(current, c_id)
+				}
+			}
+			sort.Strings(current)
+		}
+		history = appendHistory(history, change, current)
+	}
+	historyJSONasBytes, err := json.Marshal(history)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(historyJSONasBytes)
+}
+
+// ===== getPatientConsents ===============================================================
+// getPatientConsents lists every consent a patient holds, one entry per role, window and
+// watchdog with the consented columns. It reads the patient index, a composite key per
+// consent (patient~consent) kept in step with the records by every consent update, so it
+// does not need rich queries. Consents written before the index existed are not listed.
+// ========================================================================================
+const patientIndex = "patient~consent"
+
+// settingIndex is the patient index led by the setting (role, start date, end date and
+// watchdog) instead of the patient, so that evaluateAccess reads the records of the
+// patients consenting to a setting and no others. Records written before it existed give
+// no access until they are updated.
+const settingIndex = "setting~patient"
+
+// patientConsent is one setting a patient consents to.
+type patientConsent struct {
+	RoleID     string   `json:"role_id"`
+	WatchdogID string   `json:"watchdog_id"`
+	StartDate  string   `json:"start_date"`
+	EndDate    string   `json:"end_date"`
+	ColumnIDs  []string `json:"column_ids"`
+	State      string   `json:"state,omitempty"`
+}
+
+type patientConsents struct {
+	PatientID string            `json:"patient_id"`
+	Consents  []*patientConsent `json:"consents"`
+}
+
+// resolvePatient returns the patient a call acts on. A client whose certificate has a
+// consentio.patient_id attribute is that patient and may only name itself; other clients
+// must name the patient and be custodians or admins.
+func resolvePatient(stub shim.ChaincodeStubInterface, p_id string) (string, error) {
+	p_id = strings.ToLower(p_id)
+	caller, found, err := cid.GetAttributeValue(stub, "consentio.patient_id")
+	if err != nil {
+		return "", newError(errInternal, "Failed to get client patient id: %s", err.Error())
+	}
+	if found && len(caller) > 0 {
+		caller = strings.ToLower(caller)
+		if len(p_id) > 0 && p_id != caller {
+			return "", newError(errUnauthorized, "Patients may only act on their own consents")
+		}
+		return caller, nil
+	}
+	err = authorize(stub, []roleGrant{asCustodian, asAdmin})
+	if err != nil {
+		return "", err
+	}
+	if len(p_id) <= 0 {
+		return "", newError(errInvalidArgument, "patient_id must be a non-empty string")
+	}
+	return p_id, nil
+}
+
+// patient id, not needed when the caller is the patient
+var getPatientConsentsArgs = []argSpec{
+	{"patient_id", argText, false, ""},
+}
+
+func (t *SimpleChaincode) getPatientConsents(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	p_id, err := resolvePatient(stub, p["patient_id"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := patientKey(stub, p_id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := store.byPartialCompositeKey(patientIndex, []string{key})
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to read patient index: %s", err.Error()))
+	}
+	defer resultsIterator.Close()
+	result := patientConsents{PatientID: p_id, Consents: []*patientConsent{}}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		// patient id, role id, start date, end date, watchdog id
+		_, attributes, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil || len(attributes) != 5 {
+			return errorResponse(newError(errInternal, "Invalid patient index key %s", responseRange.Key))
+		}
+		marbleAsBytes, err := store.get(strings.Join(attributes, ""))
+		if err != nil {
+			return errorResponse(newError(errInternal, "Failed to get consent: %s", err.Error()))
+		} else if marbleAsBytes == nil {
+			continue
+		}
+		record := marble{}
+		err = json.Unmarshal(marbleAsBytes, &record)
+		if err != nil {
+			return errorResponse(err)
+		}
+		c_ids := append([]string{}, record.ColumnIDs...)
+		sort.Strings(c_ids)
+		result.Consents = append(result.Consents, &patientConsent{attributes[1], attributes[4], attributes[2], attributes[3], c_ids, stateNames[record.state()]})
+	}
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(resultJSONasBytes)
+}
+
+// ===== setConsentState ==================================================================
+// setConsentState moves a patient's consent for a setting to another lifecycle state,
+// along the allowed transitions. Unlike a revoke it keeps the record, so a consent can be
+// suspended (e.g. during an investigation) and later reactivated.
+// ========================================================================================
+// patient id (not needed when the caller is the patient), role id, start date, end date, watchdog id, state
+var setConsentStateArgs = []argSpec{
+	{"patient_id", argText, false, ""},
+	{"role_id", argText, true, ""},
+	{"start_date", argText, true, ""},
+	{"end_date", argText, false, ""},
+	{"watchdog_id", argText, true, ""},
+	{"state", argText, true, ""},
+}
+
+func (t *SimpleChaincode) setConsentState(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	p_id, err := resolvePatient(stub, p["patient_id"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	to, err := parseState(p["state"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := patientKey(stub, p_id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	batch := newConsentBatch(store)
+	unq_id := key + strings.ToLower(p["role_id"]) + strings.ToLower(p["start_date"]) +
+		strings.ToLower(p["end_date"]) + strings.ToLower(p["watchdog_id"])
+	record, err := batch.get(unq_id)
+	if err != nil {
+		return errorResponse(err)
+	} else if record == nil {
+		return errorResponse(newError(errNotFound, "Patient has no consent for this setting"))
+	}
+	from := record.state()
+	if from == to {
+		return shim.Success(nil)
+	}
+	err = checkTransition(stub, from, to)
+	if err != nil {
+		return errorResponse(err)
+	}
+	record.State = to
+	batch.put(unq_id, record)
+	err = batch.flush()
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+// ===== withdrawAllConsent ===============================================================
+// withdrawAllConsent revokes every consent a patient holds, found through the patient
+// index, and returns a receipt listing them. At most limit index entries are handled per
+// transaction; since the entries of withdrawn consents are deleted, calling it again
+// resumes where the previous call stopped, until the receipt says complete. The receipt
+// is also emitted as the consentWithdrawn event. Consents are withdrawn even if their
+// watchdog has since been removed.
+// ========================================================================================
+// patient id (not needed when the caller is the patient), limit
+var withdrawAllConsentArgs = []argSpec{
+	{"patient_id", argText, false, ""},
+	{"limit", argNumber, false, "100"},
+}
+
+type withdrawalReceipt struct {
+	PatientID string            `json:"patient_id"`
+	TxID      string            `json:"tx_id"`
+	Timestamp string            `json:"timestamp"`
+	Withdrawn []*patientConsent `json:"withdrawn"`
+	Complete  bool              `json:"complete"`
+}
+
+// withdrawalLimit parses the limit argument.
+func withdrawalLimit(p params) (int, error) {
+	limit, err := strconv.Atoi(p["limit"])
+	if err != nil || limit < 1 {
+		return 0, newError(errInvalidArgument, "limit must be a positive integer")
+	}
+	return limit, nil
+}
+
+// issueReceipt stamps the receipt with the transaction, emits it and returns it as the
+// response.
+func issueReceipt(stub shim.ChaincodeStubInterface, receipt *withdrawalReceipt) pb.Response {
+	receipt.TxID = stub.GetTxID()
+	txTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to get transaction time: %s", err.Error()))
+	}
+	receipt.Timestamp = time.Unix(txTime.GetSeconds(), int64(txTime.GetNanos())).UTC().Format(time.RFC3339Nano)
+	receiptJSONasBytes, err := json.Marshal(receipt)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.SetEvent("consentWithdrawn", receiptJSONasBytes)
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to set event: %s", err.Error()))
+	}
+	return shim.Success(receiptJSONasBytes)
+}
+
+func (t *SimpleChaincode) withdrawAllConsent(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	p_id, err := resolvePatient(stub, p["patient_id"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	limit, err := withdrawalLimit(p)
+	if err != nil {
+		return errorResponse(err)
+	}
+	// the receipt is recorded, so it names the patient as stored
+	p_id, err = patientKey(stub, p_id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := store.byPartialCompositeKey(patientIndex, []string{p_id})
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to read patient index: %s", err.Error()))
+	}
+	defer resultsIterator.Close()
+	batch := newConsentBatch(store)
+	receipt := &withdrawalReceipt{PatientID: p_id, Withdrawn: []*patientConsent{}, Complete: true}
+	for count := 0; resultsIterator.HasNext(); count++ {
+		if count == limit {
+			receipt.Complete = false
+			break
+		}
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		// patient id, role id, start date, end date, watchdog id
+		_, attributes, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil || len(attributes) != 5 {
+			return errorResponse(newError(errInternal, "Invalid patient index key %s", responseRange.Key))
+		}
+		// an index entry without a consent is dropped as well
+		batch.index(false, attributes...)
+		record, err := batch.get(strings.Join(attributes, ""))
+		if err != nil {
+			return errorResponse(err)
+		} else if record == nil {
+			continue
+		}
+		c_ids := append([]string{}, record.ColumnIDs...)
+		sort.Strings(c_ids)
+		op := &consentOp{p_id, "r", attributes[1], attributes[2], attributes[3], c_ids, attributes[4], "", ""}
+		_, err = applyConsent(batch, op)
+		if err != nil {
+			return errorResponse(err)
+		}
+		receipt.Withdrawn = append(receipt.Withdrawn, &patientConsent{op.RoleID, op.WatchdogID, op.StartDate, op.EndDate, c_ids, ""})
+	}
+	err = batch.flush()
+	if err != nil {
+		return errorResponse(err)
+	}
+	return issueReceipt(stub, receipt)
+}
+
+// ===== sweepExpired =====================================================================
+// sweepExpired tidies up the records whose end date is before the date of the
+// transaction. In "mark" mode (the default) consents become expired and stay on the
+// ledger; in "delete" mode they are removed with their patient index entries.
+// At most limit records are swept per transaction; while the result is not complete,
+// invoking it again with the returned cursor continues where it stopped. The result is
+// also emitted as the expiredSwept chaincode event.
+// ========================================================================================
+// mode, limit, cursor
+var sweepExpiredArgs = []argSpec{
+	{"mode", argText, false, "mark"},
+	{"limit", argNumber, false, "100"},
+	{"cursor", argText, false, ""},
+}
+
+type sweepReport struct {
+	Mode     string `json:"mode"`
+	Date     string `json:"date"`
+	Consents int    `json:"consents"`
+	Cursor   string `json:"cursor,omitempty"` // first entry left, when not complete
+	Complete bool   `json:"complete"`
+}
+
+func (t *SimpleChaincode) sweepExpired(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	mode := strings.ToLower(p["mode"])
+	if mode != "mark" && mode != "delete" {
+		return errorResponse(newError(errInvalidArgument, "mode must be mark or delete"))
+	}
+	limit, err := withdrawalLimit(p)
+	if err != nil {
+		return errorResponse(err)
+	}
+	today, err := txDate(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(p["cursor"]) > 0 {
+		if !strings.HasPrefix(p["cursor"], "\x00") {
+			return errorResponse(newError(errInvalidArgument, "cursor must be one returned by sweepExpired"))
+		}
+		objectType, attributes, err := stub.SplitCompositeKey(p["cursor"])
+		if err != nil || objectType != expiryIndex || len(attributes) != 2 {
+			return errorResponse(newError(errInvalidArgument, "cursor must be one returned by sweepExpired"))
+		}
+	}
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	batch := newConsentBatch(store)
+	report := &sweepReport{Mode: mode, Date: today, Complete: true}
+	resultsIterator, err := store.byPartialCompositeKey(expiryIndex, []string{})
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to read expiry index: %s", err.Error()))
+	}
+	err = sweepIndex(stub, batch, resultsIterator, p["cursor"], limit, report)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = batch.flush()
+	if err != nil {
+		return errorResponse(err)
+	}
+	reportJSONasBytes, err := json.Marshal(report)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.SetEvent("expiredSwept", reportJSONasBytes)
+	if err != nil {
+		return errorResponse(newError(errInternal, "Failed to set event: %s", err.Error()))
+	}
+	return shim.Success(reportJSONasBytes)
+}
+
+// sweepIndex sweeps the lapsed entries of the expiry index from the cursor on, until limit
+// records are swept.
+func sweepIndex(stub shim.ChaincodeStubInterface, batch *consentBatch, resultsIterator shim.StateQueryIteratorInterface, cursor string, limit int, report *sweepReport) error {
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil || len(attributes) != 2 {
+			return newError(errInternal, "Invalid expiry index entry %s", responseRange.Key)
+		}
+		if attributes[0] >= report.Date {
+			// the index is in date order, and entries ending today are kept until tomorrow
+			break
+		} else if responseRange.Key < cursor {
+			continue
+		}
+		if report.Consents == limit {
+			report.Cursor = responseRange.Key
+			report.Complete = false
+			break
+		}
+		entry := &expiryEntry{}
+		err = json.Unmarshal(responseRange.Value, entry)
+		if err != nil {
+			return newError(errInternal, "Invalid expiry index entry %s", responseRange.Key)
+		}
+		err = sweepEntry(stub, batch, entry, report.Mode)
+		if err != nil {
+			return err
+		}
+		report.Consents++
+		batch.setExpiry(attributes, nil)
+	}
+	return nil
+}
+
+// sweepEntry marks or deletes the record of a lapsed expiry index entry.
+func sweepEntry(stub shim.ChaincodeStubInterface, batch *consentBatch, entry *expiryEntry, mode string) error {
+	if len(entry.Key) <= 0 || entry.Kind != "consent" || len(entry.Attributes) != 5 {
+		return newError(errInternal, "Invalid expiry index entry for %s", entry.Key)
+	}
+	record, err := batch.get(entry.Key)
+	if err != nil || record == nil {
+		return err
+	}
+	if mode == "delete" {
+		batch.del(entry.Key)
+		batch.index(false, entry.Attributes...)
+	} else if record.state() != stateWithdrawn {
+		record.State = stateExpired
+		batch.put(entry.Key, record)
+	}
+	return nil
+}
+
+// ===== Example: Ad hoc rich query ========================================================
+// queryMarbles uses a query string to perform a query for marbles.
+// Query string matching state database syntax is passed in and executed as is.
+// Supports ad hoc queries that can be defined at runtime by the client.
+// If this is not desired, follow the queryMarblesForOwner example for parameterized queries.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+// query string, either a JSON string or a selector object when named
+var queryArgs = []argSpec{
+	{"query", argJSON, true, ""},
+}
+
+func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	//   0
+	// "queryString"
+	queryString := p["query"]
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(queryResults)
+}
+
+// =========================================================================================
+// getQueryResultForQueryString executes the passed in query string.
+// Result set is built and returned as a byte array containing the JSON results.
+// =========================================================================================
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+
+	fmt.Printf("- getQueryResultForQueryString queryString:\n%s\n", queryString)
+
+	store, err := newConsentStore(stub)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := store.query(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+/*func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface, p params) pb.Response {
+
+	if len(args) < 1 {
+		return errorResponse(newError(errInvalidArgument, "Incorrect number of arguments. Expecting 1"))
+	}
+
+	marbleName := args[0]
+
+	fmt.Printf("- start getHistoryForMarble: %s\n", marbleName)
+
+	resultsIterator, err := stub.GetHistoryForKey(marbleName)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	// buffer is a JSON array containing historic values for the marble
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		// Add a comma before array members, suppress it for the first array member
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"TxId\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(response.TxId)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Value\":")
+		// if it was a delete operation on given key, then we need to set the
+		//corresponding value null. Else, we will write the response.Value
+		//as-is (as the Value itself a JSON marble)
+		if response.IsDelete {
+			buffer.WriteString("null")
+		} else {
+			buffer.WriteString(string(response.Value))
+		}
+
+		buffer.WriteString(", \"Timestamp\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"IsDelete\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(strconv.FormatBool(response.IsDelete))
+		buffer.WriteString("\"")
+
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	fmt.Printf("- getHistoryForMarble returning:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}*/
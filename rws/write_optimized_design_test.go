@@ -0,0 +1,911 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package rws
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddhruvkr/Consentio/memstub"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The consent setting most tests use; the ledger clock is inside its window.
+const (
+	s_date = "20150101"
+	e_date = "20160101"
+)
+
+// fixture is a channel governed by Org1MSP with the hippa watchdog (Org2MSP) governing
+// role all, and one client of each role. RWS keeps no role approvals, so there is no
+// updateRole (nor initialize) to test here.
+type fixture struct {
+	t         *testing.T
+	ledger    *memstub.Ledger
+	cc        *SimpleChaincode
+	admin     *memstub.Identity // Org1MSP client without attributes
+	custodian *memstub.Identity
+	patient   *memstub.Identity // patient 2
+	consumer  *memstub.Identity
+}
+
+func identity(t *testing.T, mspID string, name string, attrs map[string]string) *memstub.Identity {
+	id, err := memstub.NewIdentity(mspID, name, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func newFixture(t *testing.T) *fixture {
+	f := &fixture{t: t, ledger: memstub.NewLedger(), cc: new(SimpleChaincode)}
+	f.ledger.Clock = func() time.Time { return time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC) }
+	f.admin = identity(t, "Org1MSP", "admin", nil)
+	f.custodian = identity(t, "Org1MSP", "custodian", map[string]string{"consentio.role": "custodian"})
+	f.patient = identity(t, "Org1MSP", "patient2", map[string]string{"consentio.role": "patient", "consentio.patient_id": "2"})
+	f.consumer = identity(t, "Org3MSP", "dc1", map[string]string{"consentio.role": "consumer", "consentio.consumer_id": "dc1"})
+	response := f.ledger.Init(f.cc, f.admin, "Org1MSP")
+	if response.Status != shim.OK {
+		t.Fatalf("Init: %s", response.Message)
+	}
+	f.ok(f.admin, "registerWatchdog", "hippa", "Org2MSP", "", "all")
+	return f
+}
+
+// invoke endorses the call and commits it when it succeeds.
+func (f *fixture) invoke(id *memstub.Identity, args ...string) (pb.Response, *memstub.Tx) {
+	return f.ledger.Invoke(f.cc, id, nil, args...)
+}
+
+// ok invokes a call that must succeed and returns its payload.
+func (f *fixture) ok(id *memstub.Identity, args ...string) []byte {
+	f.t.Helper()
+	response, _ := f.invoke(id, args...)
+	if response.Status != shim.OK {
+		f.t.Fatalf("%v: %s", args, response.Message)
+	}
+	return response.Payload
+}
+
+// fails invokes a call that must fail with the given error code.
+func (f *fixture) fails(code string, id *memstub.Identity, args ...string) {
+	f.t.Helper()
+	response, _ := f.invoke(id, args...)
+	if response.Status == shim.OK {
+		f.t.Fatalf("%v succeeded, want %s", args, code)
+	}
+	cerr := &chaincodeError{}
+	err := json.Unmarshal(response.Payload, cerr)
+	if err != nil {
+		f.t.Fatalf("%v: error payload %q: %v", args, response.Payload, err)
+	}
+	if cerr.Code != code {
+		f.t.Fatalf("%v failed with %s (%s), want %s", args, cerr.Code, cerr.Message, code)
+	}
+}
+
+// record returns the stored record of a patient for the test setting, nil if there is none.
+func (f *fixture) record(p_id string) *marble {
+	f.t.Helper()
+	marbleAsBytes := f.ledger.State()[p_id+"all"+s_date+e_date+"hippa"]
+	if marbleAsBytes == nil {
+		return nil
+	}
+	record := &marble{}
+	err := json.Unmarshal(marbleAsBytes, record)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return record
+}
+
+// indexed tells whether the patient index has the entry of a patient's record.
+func (f *fixture) indexed(p_id string) bool {
+	key, _ := f.ledger.NewTx(nil, nil).CreateCompositeKey(patientIndex, []string{p_id, "all", s_date, e_date, "hippa"})
+	return f.ledger.State()[key] != nil
+}
+
+func (f *fixture) grant(p_id string, columns string) {
+	f.t.Helper()
+	f.ok(f.custodian, "updateConsent", p_id, "g", "all", s_date, e_date, columns, "hippa")
+}
+
+func (f *fixture) revoke(p_id string, columns string) {
+	f.t.Helper()
+	f.ok(f.custodian, "updateConsent", p_id, "r", "all", s_date, e_date, columns, "hippa")
+}
+
+func (f *fixture) trace(payload []byte) *accessTrace {
+	f.t.Helper()
+	trace := &accessTrace{}
+	err := json.Unmarshal(payload, trace)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return trace
+}
+
+func writes(tx *memstub.Tx, key string) bool {
+	for _, written := range tx.WriteSet() {
+		if written == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGrantStoresColumnsOfPatient(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102")
+	f.grant("2", "103,101")
+	record := f.record("2")
+	if record == nil {
+		t.Fatalf("no record for patient 2")
+	}
+	if len(record.ColumnIDs) != 3 || contains(record.ColumnIDs, "103") == -1 {
+		t.Errorf("columns = %v, want 101, 102 and 103", record.ColumnIDs)
+	}
+	if record.state() != stateActive {
+		t.Errorf("state = %d, want active", record.state())
+	}
+	if !f.indexed("2") {
+		t.Errorf("no index entry for the record")
+	}
+}
+
+func TestDuplicateGrantKeepsColumns(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	response, tx := f.invoke(f.custodian, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if record := f.record("2"); len(record.ColumnIDs) != 1 {
+		t.Errorf("columns after a duplicate grant = %v", record.ColumnIDs)
+	}
+	if len(response.Payload) != 0 || len(tx.WriteSet()) != 0 {
+		t.Errorf("duplicate grant returned %s and wrote %v", response.Payload, tx.WriteSet())
+	}
+}
+
+func TestRevokeLastColumnDeletesRecord(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102")
+	f.revoke("2", "101")
+	if record := f.record("2"); record == nil || len(record.ColumnIDs) != 1 || record.ColumnIDs[0] != "102" {
+		t.Fatalf("record after a partial revoke = %+v", record)
+	}
+	response, tx := f.invoke(f.custodian, "updateConsent", "2", "r", "all", s_date, e_date, "102", "hippa")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if !writes(tx, "2all"+s_date+e_date+"hippa") {
+		t.Errorf("revoke did not delete the record")
+	}
+	if f.record("2") != nil {
+		t.Errorf("record without columns still exists")
+	}
+	if f.indexed("2") {
+		t.Errorf("index entry of the deleted record still exists")
+	}
+}
+
+func TestRevokeWithoutConsentWritesNothing(t *testing.T) {
+	f := newFixture(t)
+	response, tx := f.invoke(f.custodian, "updateConsent", "2", "r", "all", s_date, e_date, "101", "hippa")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if len(tx.WriteSet()) != 0 {
+		t.Errorf("revoking a missing consent wrote %v", tx.WriteSet())
+	}
+}
+
+func TestUpdateConsentRejectsBadArguments(t *testing.T) {
+	f := newFixture(t)
+	f.fails(errInvalidArgument, f.custodian, "updateConsent", "2", "x", "all", s_date, e_date, "101", "hippa")
+	f.fails(errInvalidArgument, f.custodian, "updateConsent", "2", "g", "all", "2015-01-01", e_date, "101", "hippa")
+	f.fails(errNotFound, f.custodian, "updateConsent", "2", "g", "all", s_date, e_date, "101", "nowatchdog")
+	f.fails(errUnauthorized, f.consumer, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+}
+
+func TestAccessConsentToPseudonyms(t *testing.T) {
+	f := newFixture(t)
+	response := f.ledger.Init(f.cc, f.admin, `{"require_pseudonyms":true}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	pn := strings.Repeat("ab", 32)
+	f.ok(f.custodian, "registerPseudonym", pn)
+	f.grant(pn, "101")
+	trace := f.trace(f.ok(f.custodian, "explainAccess", "all", s_date, e_date, "101", "hippa"))
+	if !trace.Granted || len(trace.Patients["101"]) != 1 || trace.Patients["101"][0] != pn {
+		t.Errorf("trace = %+v, want the pseudonym consenting", trace)
+	}
+	f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa")
+}
+
+func TestNamedArguments(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.custodian, "updateConsent", `{"patient_id":"2","action":"g","role_id":"all","start_date":"20150101",
+		"end_date":"20160101","column_ids":["101","102"],"watchdog_id":"hippa"}`)
+	if record := f.record("2"); record == nil || len(record.ColumnIDs) != 2 {
+		t.Fatalf("record after a named grant = %+v", record)
+	}
+	for _, args := range []string{
+		// a list item would be split into two columns
+		`{"patient_id":"3","action":"g","role_id":"all","start_date":"20150101","end_date":"20160101","column_ids":["101,103"],"watchdog_id":"hippa"}`,
+		// text must be a JSON string
+		`{"patient_id":3,"action":"g","role_id":"all","start_date":"20150101","end_date":"20160101","column_ids":["103"],"watchdog_id":"hippa"}`,
+		`{"patient_id":"3","action":"g","role_id":"all","start_date":20150101,"end_date":"20160101","column_ids":["103"],"watchdog_id":"hippa"}`,
+		`{"patient_id":"3","action":"g","role_id":"all","start_date":"20150101","end_date":"20160101","column_ids":[103],"watchdog_id":"hippa"}`,
+		`{"patient_id":"3","action":"g","role_id":"all","start_date":"20150101","end_date":"20160101","column_ids":["103"],"watchdog":"hippa"}`,
+	} {
+		f.fails(errInvalidArgument, f.custodian, "updateConsent", args)
+	}
+	if f.record("3") != nil {
+		t.Errorf("an invalid grant was applied")
+	}
+	// a number may be given as one
+	f.ok(f.custodian, "sweepExpired", `{"mode":"mark","limit":10}`)
+}
+
+func TestTransientArguments(t *testing.T) {
+	f := newFixture(t)
+	transient := map[string][]byte{"patient_id": []byte("3"), "column_ids": []byte(`["101","102"]`)}
+	response, tx := f.ledger.Invoke(f.cc, f.custodian, transient, "updateConsent", "", "g", "all", s_date, e_date, "", "hippa")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	for _, arg := range tx.GetStringArgs() {
+		if arg == "3" {
+			t.Errorf("the patient id is among the recorded arguments %v", tx.GetStringArgs())
+		}
+	}
+	if record := f.record("3"); record == nil || len(record.ColumnIDs) != 2 {
+		t.Fatalf("record after a transient grant = %+v", record)
+	}
+	for _, transient := range []map[string][]byte{
+		{"patient_id": []byte("3"), "column_ids": []byte(`["103,104"]`)},
+		{"patient_id": []byte("3"), "column_ids": []byte(`[103]`)},
+	} {
+		response, _ = f.ledger.Invoke(f.cc, f.custodian, transient, "updateConsent", "", "g", "all", s_date, e_date, "", "hippa")
+		if response.Status == shim.OK {
+			t.Errorf("transient %s accepted", transient["column_ids"])
+		}
+	}
+	// an argument may not be given both ways
+	response, _ = f.ledger.Invoke(f.cc, f.custodian, map[string][]byte{"patient_id": []byte("3")}, "updateConsent", "3", "g", "all", s_date, e_date, "103", "hippa")
+	if response.Status == shim.OK {
+		t.Errorf("patient id given twice accepted")
+	}
+}
+
+func TestAccessConsent(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102")
+	f.grant("3", "101")
+	// patients outside the setting do not count
+	f.ok(f.custodian, "updateConsent", "4", "g", "all", s_date, "20170101", "101,102", "hippa")
+	trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101,102,103", "hippa"))
+	if !trace.Granted {
+		t.Fatalf("access denied: %s", trace.Reason)
+	}
+	if trace.Columns["101"] != 2 || trace.Columns["102"] != 1 || trace.Columns["103"] != 0 {
+		t.Errorf("columns = %v", trace.Columns)
+	}
+	if trace.Certificate == nil {
+		t.Errorf("no access certificate issued")
+	}
+}
+
+func TestAccessConsentDenied(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	// consent not found: nobody consented to the columns
+	f.fails(errNotFound, f.consumer, "accessConsent", "all", s_date, e_date, "102,103", "hippa")
+	// nor in another window
+	f.fails(errNotFound, f.consumer, "accessConsent", "all", s_date, "20151231", "101", "hippa")
+	// only active consents count
+	f.ok(f.custodian, "setConsentState", "2", "all", s_date, e_date, "hippa", "suspended")
+	f.fails(errNotFound, f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa")
+	f.fails(errNotFound, f.consumer, "accessConsent", "all", s_date, e_date, "101", "nowatchdog")
+	f.fails(errUnauthorized, f.patient, "accessConsent", "all", s_date, e_date, "101", "hippa")
+}
+
+func TestVerifyAccessCertificateChecksHolder(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa"))
+	certificateJSONasBytes, err := json.Marshal(trace.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := string(certificateJSONasBytes)
+	holder := trace.Certificate.Holder
+	check := &certificateCheck{}
+	json.Unmarshal(f.ok(f.custodian, "verifyAccessCertificate", certificate, holder), check)
+	if !check.Match || !check.Current {
+		t.Errorf("check = %+v", check)
+	}
+	json.Unmarshal(f.ok(f.consumer, "verifyAccessCertificate", certificate, ""), check)
+	if !check.Match {
+		t.Errorf("holder's own check = %+v", check)
+	}
+	// shown by anyone else it is worthless
+	other := identity(t, "Org3MSP", "dc2", map[string]string{"consentio.role": "consumer", "consentio.consumer_id": "dc2"})
+	f.fails(errUnauthorized, other, "verifyAccessCertificate", certificate, "")
+	f.fails(errUnauthorized, other, "verifyAccessCertificate", certificate, holder)
+	f.fails(errUnauthorized, f.custodian, "verifyAccessCertificate", certificate, "someone else")
+	f.fails(errInvalidArgument, f.custodian, "verifyAccessCertificate", certificate, "")
+	// custodians do not request access themselves
+	f.fails(errUnauthorized, f.custodian, "accessConsent", "all", s_date, e_date, "101", "hippa")
+}
+
+// The RWS design keeps one record per patient, with no patient sets to commit to, so
+// consent proofs are only offered by IWS.
+func TestConsentProofNotOffered(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.fails(errInvalidArgument, f.custodian, "getConsentProof", "2", "all", s_date, e_date, "101", "hippa")
+}
+
+// governance returns the stored governance record.
+func (f *fixture) governance() *governance {
+	f.t.Helper()
+	govKey, _ := f.ledger.NewTx(nil, nil).CreateCompositeKey("governance", []string{})
+	gov := &governance{}
+	err := json.Unmarshal(f.ledger.State()[govKey], gov)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return gov
+}
+
+func TestUpgradeMergesGovernance(t *testing.T) {
+	f := newFixture(t)
+	response := f.ledger.Init(f.cc, f.admin, `{"require_pseudonyms":true,"secret_collection":"consentioSecrets"}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	// MSP ids replace only the governors
+	response = f.ledger.Init(f.cc, f.admin, "Org1MSP", "Org4MSP")
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	gov := f.governance()
+	if len(gov.MSPIDs) != 2 || !gov.RequirePseudonyms || gov.SecretCollection != "consentioSecrets" {
+		t.Errorf("governance after upgrade = %+v", gov)
+	}
+}
+
+func TestUpgradeKeepsStorageOnceConsentExists(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	for _, arg := range []string{`{"require_pseudonyms":true}`, `{"consent_collection":"consentioConsents"}`, `{"hash_patient_ids":true,"secret_collection":"consentioSecrets"}`} {
+		response := f.ledger.Init(f.cc, f.admin, arg)
+		cerr := &chaincodeError{}
+		json.Unmarshal(response.Payload, cerr)
+		if response.Status == shim.OK || cerr.Code != errConflict {
+			t.Errorf("upgrade with %s: status %d %s", arg, response.Status, response.Message)
+		}
+	}
+	response := f.ledger.Init(f.cc, f.admin, `{"msp_ids":["Org1MSP","Org4MSP"]}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if gov := f.governance(); len(gov.MSPIDs) != 2 || gov.RequirePseudonyms || gov.ConsentCollection != "" || gov.HashPatientIDs {
+		t.Errorf("governance after upgrade = %+v", gov)
+	}
+}
+
+func TestPatientUpdatesOnlyOwnConsent(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.patient, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	if f.record("2") == nil {
+		t.Errorf("patient could not grant its own consent")
+	}
+	f.fails(errUnauthorized, f.patient, "updateConsent", "3", "g", "all", s_date, e_date, "101", "hippa")
+	if f.record("3") != nil {
+		t.Errorf("patient 2 granted consent for patient 3")
+	}
+}
+
+func TestRolesBoundToIssuingMSP(t *testing.T) {
+	f := newFixture(t)
+	// Org3MSP does not govern the channel, so the custodian and patient roles it issues count for nothing
+	foreign := identity(t, "Org3MSP", "custodian", map[string]string{"consentio.role": "custodian"})
+	f.fails(errUnauthorized, foreign, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	f.fails(errUnauthorized, foreign, "getPatientConsents", "2")
+	patient := identity(t, "Org3MSP", "patient2", map[string]string{"consentio.role": "patient", "consentio.patient_id": "2"})
+	f.fails(errUnauthorized, patient, "updateConsent", "2", "g", "all", s_date, e_date, "101", "hippa")
+	f.grant("2", "101")
+	// consumers come from any MSP until the governance names theirs
+	f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa")
+	response := f.ledger.Init(f.cc, f.admin, `{"consumer_msp_ids":["Org4MSP"]}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	f.fails(errUnauthorized, f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa")
+	member := identity(t, "Org4MSP", "dc1", map[string]string{"consentio.role": "consumer", "consentio.consumer_id": "dc1"})
+	f.ok(member, "accessConsent", "all", s_date, e_date, "101", "hippa")
+}
+
+func TestConsentHistoryOfOwnConsentOnly(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.grant("3", "101")
+	history := []historyEntry{}
+	err := json.Unmarshal(f.ok(f.patient, "getConsentHistory", "2", "all", s_date, e_date, "hippa", "101"), &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("history of patient 2 = %+v", history)
+	}
+	f.fails(errUnauthorized, f.patient, "getConsentHistory", "3", "all", s_date, e_date, "hippa", "101")
+}
+
+func (f *fixture) consents(id *memstub.Identity, args ...string) *patientConsents {
+	f.t.Helper()
+	result := &patientConsents{}
+	err := json.Unmarshal(f.ok(id, append([]string{"getPatientConsents"}, args...)...), result)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return result
+}
+
+func TestGetPatientConsents(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "102,101")
+	f.ok(f.custodian, "updateConsent", "2", "g", "all", s_date, "20170101", "103", "hippa")
+	f.grant("3", "104")
+	// the patient lists its own consents, one entry per setting
+	result := f.consents(f.patient)
+	if result.PatientID != "2" || len(result.Consents) != 2 {
+		t.Fatalf("consents = %+v, want two settings of patient 2", result)
+	}
+	want := []patientConsent{{"all", "hippa", s_date, e_date, []string{"101", "102"}, "active"},
+		{"all", "hippa", s_date, "20170101", []string{"103"}, "active"}}
+	for i, consent := range result.Consents {
+		if !reflect.DeepEqual(*consent, want[i]) {
+			t.Errorf("consent %d = %+v, want %+v", i, *consent, want[i])
+		}
+	}
+	f.fails(errUnauthorized, f.patient, "getPatientConsents", "3")
+	// custodians name the patient
+	f.fails(errInvalidArgument, f.custodian, "getPatientConsents", "")
+	if result := f.consents(f.custodian, "3"); len(result.Consents) != 1 || result.Consents[0].ColumnIDs[0] != "104" {
+		t.Errorf("consents of patient 3 = %+v", result)
+	}
+	// revoked consents are no longer listed
+	f.revoke("2", "101,102")
+	if result := f.consents(f.custodian, "2"); len(result.Consents) != 1 || result.Consents[0].EndDate != "20170101" {
+		t.Errorf("consents after revoke = %+v", result)
+	}
+	if result := f.consents(f.custodian, "9"); result.Consents == nil || len(result.Consents) != 0 {
+		t.Errorf("consents of a patient without any = %+v, want an empty list", result)
+	}
+}
+
+func (f *fixture) withdraw(id *memstub.Identity, args ...string) *withdrawalReceipt {
+	f.t.Helper()
+	response, tx := f.invoke(id, append([]string{"withdrawAllConsent"}, args...)...)
+	if response.Status != shim.OK {
+		f.t.Fatalf("withdrawAllConsent %v: %s", args, response.Message)
+	}
+	if event := tx.Event(); event == nil || event.Name != "consentWithdrawn" || string(event.Payload) != string(response.Payload) {
+		f.t.Errorf("event = %+v, want the receipt as consentWithdrawn", event)
+	}
+	receipt := &withdrawalReceipt{}
+	err := json.Unmarshal(response.Payload, receipt)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return receipt
+}
+
+func TestWithdrawAllConsent(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102")
+	f.ok(f.custodian, "updateConsent", "2", "g", "all", s_date, "20170101", "103", "hippa")
+	f.grant("3", "101")
+	f.fails(errUnauthorized, f.patient, "withdrawAllConsent", "3", "10")
+	f.fails(errInvalidArgument, f.custodian, "withdrawAllConsent", "2", "0")
+	// withdrawn even though the watchdog has since been removed
+	f.ok(f.admin, "removeWatchdog", "hippa")
+	// each index entry is one setting
+	receipt := f.withdraw(f.patient, "", "1")
+	if receipt.PatientID != "2" || receipt.Complete || len(receipt.Withdrawn) != 1 || len(receipt.Withdrawn[0].ColumnIDs) != 2 {
+		t.Fatalf("first receipt = %+v, want the two columns of the first setting", receipt)
+	}
+	receipt = f.withdraw(f.patient, "", "1")
+	if !receipt.Complete || len(receipt.Withdrawn) != 1 || receipt.Withdrawn[0].EndDate != "20170101" {
+		t.Fatalf("second receipt = %+v, want the rest", receipt)
+	}
+	if f.record("2") != nil || f.indexed("2") || f.record("3") == nil {
+		t.Errorf("withdrawn consents still stored or indexed, or patient 3's removed")
+	}
+	if result := f.consents(f.custodian, "2"); len(result.Consents) != 0 {
+		t.Errorf("consents after withdrawal = %+v", result)
+	}
+	if receipt := f.withdraw(f.custodian, "2"); !receipt.Complete || len(receipt.Withdrawn) != 0 {
+		t.Errorf("receipt without consents = %+v", receipt)
+	}
+}
+
+func TestPrivateConsentCollection(t *testing.T) {
+	f := newFixture(t)
+	response := f.ledger.Init(f.cc, f.admin, `{"consent_collection":"consentioConsents"}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	f.grant("2", "101")
+	key := "2all" + s_date + e_date + "hippa"
+	private := f.ledger.PrivateState("consentioConsents")
+	if private[key] == nil || f.ledger.State()[key] != nil {
+		t.Fatalf("record is not kept only in the collection")
+	}
+	indexKey, _ := f.ledger.NewTx(nil, nil).CreateCompositeKey(patientIndex, []string{"2", "all", s_date, e_date, "hippa"})
+	if private[indexKey] == nil || f.ledger.State()[indexKey] != nil {
+		t.Errorf("index entry is not kept only in the collection")
+	}
+	// public state holds the hash any organisation can check a record shown to it against
+	stored := string(private[key])
+	check := map[string]bool{}
+	json.Unmarshal(f.ok(f.consumer, "verifyConsentRecord", key, stored), &check)
+	if !check["match"] {
+		t.Errorf("stored record does not match its hash")
+	}
+	json.Unmarshal(f.ok(f.consumer, "verifyConsentRecord", key, stored+" "), &check)
+	if check["match"] {
+		t.Errorf("altered record matches the hash")
+	}
+	f.fails(errNotFound, f.consumer, "verifyConsentRecord", "102all"+s_date+e_date+"hippa", "{}")
+	// access and the patient's listing read the private records
+	if trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa")); !trace.Granted {
+		t.Errorf("access denied on a private consent: %s", trace.Reason)
+	}
+	if result := f.consents(f.custodian, "2"); len(result.Consents) != 1 {
+		t.Errorf("consents = %+v", result)
+	}
+	// Fabric keeps no history of private data
+	f.fails(errInvalidArgument, f.custodian, "getConsentHistory", "2", "all", s_date, e_date, "hippa")
+	// a revoke removes the hash with the record
+	f.revoke("2", "101")
+	if f.ledger.PrivateState("consentioConsents")[key] != nil {
+		t.Errorf("revoked record still stored")
+	}
+	f.fails(errNotFound, f.consumer, "verifyConsentRecord", key, stored)
+}
+
+// initWithSalt calls Init with the salt in the transient data.
+func (f *fixture) initWithSalt(salt string, arg string) pb.Response {
+	tx := f.ledger.NewTx(f.admin, map[string][]byte{"salt": []byte(salt)}, "init", arg)
+	response := f.cc.Init(tx)
+	if response.Status == shim.OK {
+		f.ledger.Commit(tx)
+	}
+	return response
+}
+
+func TestHashedPatientIDs(t *testing.T) {
+	f := newFixture(t)
+	if response := f.initWithSalt("s4lt", `{"hash_patient_ids":true}`); response.Status == shim.OK {
+		t.Errorf("hash_patient_ids accepted without a secret_collection")
+	}
+	response := f.initWithSalt("s4lt", `{"hash_patient_ids":true,"secret_collection":"consentioSecrets"}`)
+	if response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	if string(f.ledger.PrivateState("consentioSecrets")["patient_salt"]) != "s4lt" {
+		t.Errorf("salt not kept in the secret collection")
+	}
+	f.grant("2", "101")
+	hashed := keyedHash([]byte("s4lt"), "2")
+	if f.record(hashed) == nil || f.record("2") != nil || !f.indexed(hashed) {
+		t.Errorf("record not stored under the hashed id")
+	}
+	// callers keep using the plain id
+	if result := f.consents(f.patient); len(result.Consents) != 1 {
+		t.Errorf("consents = %+v", result)
+	}
+	trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa"))
+	if len(trace.Patients["101"]) != 1 || trace.Patients["101"][0] != hashed {
+		t.Errorf("granted patients = %v, want the hashed id", trace.Patients)
+	}
+	// an upgrade may leave the salt out, but not change it
+	if response := f.ledger.Init(f.cc, f.admin, "Org1MSP"); response.Status != shim.OK {
+		t.Errorf("upgrade without the salt: %s", response.Message)
+	}
+	if response := f.initWithSalt("other", "Org1MSP"); response.Status == shim.OK {
+		t.Errorf("salt changed on upgrade")
+	}
+	f.revoke("2", "101")
+	if result := f.consents(f.custodian, "2"); len(result.Consents) != 0 {
+		t.Errorf("consents after revoke = %+v", result)
+	}
+}
+
+func TestSetConsentState(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101,102")
+	f.grant("3", "101")
+	f.ok(f.custodian, "setConsentState", "2", "all", s_date, e_date, "hippa", "suspended")
+	if record := f.record("2"); record.state() != stateSuspended {
+		t.Fatalf("record = %+v, want it suspended", record)
+	}
+	// only active consents give access
+	trace := f.trace(f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101,102", "hippa"))
+	if trace.Columns["101"] != 1 || trace.Columns["102"] != 0 {
+		t.Errorf("columns = %v, want the suspended patient left out", trace.Columns)
+	}
+	// neither the patient nor a new grant lifts the suspension
+	f.fails(errUnauthorized, f.patient, "setConsentState", "", "all", s_date, e_date, "hippa", "active")
+	f.grant("2", "101")
+	if f.record("2").state() != stateSuspended {
+		t.Errorf("a grant lifted the suspension")
+	}
+	if result := f.consents(f.patient); len(result.Consents) != 1 || result.Consents[0].State != "suspended" {
+		t.Errorf("consents = %+v, want the suspended one", result)
+	}
+	f.ok(f.custodian, "setConsentState", "2", "all", s_date, e_date, "hippa", "active")
+	// the patient withdraws, keeping the record; only a new grant undoes that
+	f.ok(f.patient, "setConsentState", "", "all", s_date, e_date, "hippa", "withdrawn")
+	if f.record("2").state() != stateWithdrawn {
+		t.Errorf("consent not withdrawn")
+	}
+	f.fails(errConflict, f.custodian, "setConsentState", "2", "all", s_date, e_date, "hippa", "active")
+	f.fails(errInvalidArgument, f.custodian, "setConsentState", "2", "all", s_date, e_date, "hippa", "paused")
+	f.fails(errNotFound, f.custodian, "setConsentState", "4", "all", s_date, e_date, "hippa", "suspended")
+	f.grant("2", "101")
+	if f.record("2").state() != stateActive {
+		t.Errorf("a new grant did not reactivate the withdrawn consent")
+	}
+}
+
+func TestBulkUpdateConsentAtomic(t *testing.T) {
+	f := newFixture(t)
+	grant := func(p_id string, c_id string, w_id string) *consentOp {
+		return &consentOp{PatientID: p_id, Action: "g", RoleID: "all", StartDate: s_date, EndDate: e_date, ColumnIDs: []string{c_id}, WatchdogID: w_id}
+	}
+	ops := []*consentOp{grant("2", "101", "hippa"), grant("3", "101", "nowatchdog"), grant("4", "102", "hippa")}
+	opsAsBytes, _ := json.Marshal(ops)
+	// atomic is the default: one invalid operation and nothing is written
+	response, tx := f.invoke(f.custodian, "bulkUpdateConsent", string(opsAsBytes))
+	if response.Status == shim.OK || len(tx.WriteSet()) != 0 {
+		t.Fatalf("bulk update with an invalid operation succeeded or wrote %v", tx.WriteSet())
+	}
+	failure := &struct {
+		Code    string     `json:"code"`
+		Details bulkReport `json:"details"`
+	}{}
+	err := json.Unmarshal(response.Payload, failure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := failure.Details.Results
+	if failure.Code != errInvalidArgument || failure.Details.Invalid != 1 || len(results) != 3 ||
+		results[0].Status != "skipped" || results[1].Status != "invalid" || results[1].Code != errNotFound || results[2].Status != "skipped" {
+		t.Errorf("failure = %+v", failure)
+	}
+	if f.record("2") != nil || f.record("4") != nil {
+		t.Errorf("atomic bulk update applied part of the operations")
+	}
+	// with every operation valid all are applied, and repeats report unchanged
+	ops[1].WatchdogID = "hippa"
+	ops = append(ops, grant("2", "101", "hippa"))
+	opsAsBytes, _ = json.Marshal(ops)
+	report := &bulkReport{}
+	err = json.Unmarshal(f.ok(f.custodian, "bulkUpdateConsent", string(opsAsBytes), "atomic"), report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Mode != "atomic" || report.Applied != 3 || report.Unchanged != 1 || report.Results[3].Status != "unchanged" {
+		t.Errorf("report = %+v", report)
+	}
+	if f.record("2") == nil || f.record("3") == nil || f.record("4") == nil {
+		t.Errorf("operations not applied")
+	}
+	f.fails(errInvalidArgument, f.custodian, "bulkUpdateConsent", string(opsAsBytes), "some")
+	f.fails(errInvalidArgument, f.custodian, "bulkUpdateConsent", "{}", "atomic")
+}
+
+func TestExplainAccessWithholdsPatients(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	// nobody consented to column 102, so the request is denied
+	trace := f.trace(f.ok(f.custodian, "explainAccess", "all", s_date, e_date, "102", "hippa"))
+	if trace.Granted || trace.Patients != nil {
+		t.Errorf("denied trace = %+v", trace)
+	}
+	f.grant("7", "101")
+	trace = f.trace(f.ok(f.custodian, "explainAccess", "all", s_date, e_date, "101", "hippa"))
+	if !trace.Granted || len(trace.Patients["101"]) != 2 {
+		t.Errorf("granted trace for the custodian = %+v", trace)
+	}
+	trace = f.trace(f.ok(f.consumer, "explainAccess", "all", s_date, e_date, "101", "hippa"))
+	if !trace.Granted || trace.Patients != nil {
+		t.Errorf("granted trace for the consumer = %+v", trace)
+	}
+}
+
+// signer is a patient's Ed25519 key pair.
+type signer struct {
+	pem  string
+	priv ed25519.PrivateKey
+}
+
+func newSigner(t *testing.T) *signer {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), priv}
+}
+
+func (s *signer) sign(t *testing.T, message interface{}) string {
+	messageAsBytes, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.priv, messageAsBytes))
+}
+
+func TestFirstPatientKeyRegisteredByPatient(t *testing.T) {
+	f := newFixture(t)
+	first, second := newSigner(t), newSigner(t)
+	f.fails(errUnauthorized, f.custodian, "registerPatientKey", "2", first.pem)
+	f.ok(f.patient, "registerPatientKey", "2", first.pem)
+	// the current key signs its replacement, which the custodian may submit
+	f.fails(errConflict, f.custodian, "registerPatientKey", "2", second.pem)
+	signature := first.sign(t, map[string]string{"patient_id": "2", "public_key": second.pem})
+	f.ok(f.custodian, "registerPatientKey", "2", second.pem, signature)
+}
+
+func TestNonceUsedOncePerTransaction(t *testing.T) {
+	f := newFixture(t)
+	key := newSigner(t)
+	f.ok(f.patient, "registerPatientKey", "2", key.pem)
+	var ops []*consentOp
+	for _, c_id := range []string{"101", "102"} {
+		op := &consentOp{"2", "g", "all", s_date, e_date, []string{c_id}, "hippa", "", "n1"}
+		op.Signature = key.sign(t, signedOperation{op.PatientID, op.Action, op.RoleID, op.StartDate, op.EndDate, op.ColumnIDs, op.WatchdogID, op.Nonce})
+		ops = append(ops, op)
+	}
+	opsAsBytes, _ := json.Marshal(ops)
+	report := &bulkReport{}
+	err := json.Unmarshal(f.ok(f.custodian, "bulkUpdateConsent", string(opsAsBytes), "per-item"), report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Results[0].Status != "applied" || report.Results[1].Code != errConflict {
+		t.Errorf("results = %+v", report.Results)
+	}
+	// nor can it be used again in a later transaction
+	f.fails(errConflict, f.custodian, "updateConsent", "2", "g", "all", s_date, e_date, "102", "hippa", ops[1].Signature, "n1")
+}
+
+func TestAccessConsentAfterWindowExpired(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	// the last day of the window still gives access, the next does not, swept or not
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 1, 23, 0, 0, 0, time.UTC) }
+	f.ok(f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa")
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC) }
+	f.fails(errExpired, f.consumer, "accessConsent", "all", s_date, e_date, "101", "hippa")
+}
+
+func (f *fixture) sweep(args ...string) *sweepReport {
+	f.t.Helper()
+	report := &sweepReport{}
+	err := json.Unmarshal(f.ok(f.custodian, append([]string{"sweepExpired"}, args...)...), report)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return report
+}
+
+func TestSweepExpiredMarksLapsedConsents(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.ok(f.custodian, "updateConsent", "2", "g", "all", s_date, "20170101", "101", "hippa")
+	// a patient id that looks like a key of the expiry index is a patient like any other
+	f.ok(f.custodian, "updateConsent", "expiry_20000101_x", "g", "all", s_date, "20170101", "101", "hippa")
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC) }
+	if r := f.sweep(); r.Consents != 0 || !r.Complete {
+		t.Errorf("sweep on the last day = %+v", r)
+	}
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 2, 12, 0, 0, 0, time.UTC) }
+	if r := f.sweep(); r.Consents != 1 || !r.Complete {
+		t.Errorf("sweep = %+v, want one consent", r)
+	}
+	if record := f.record("2"); record == nil || record.state() != stateExpired {
+		t.Errorf("lapsed record = %+v, want it expired", record)
+	}
+	if !f.indexed("2") {
+		t.Errorf("marking removed the index entry")
+	}
+	for _, unq_id := range []string{"2all" + s_date + "20170101hippa", "expiry_20000101_xall" + s_date + "20170101hippa"} {
+		record := &marble{}
+		json.Unmarshal(f.ledger.State()[unq_id], record)
+		if len(record.ColumnIDs) != 1 || record.state() != stateActive {
+			t.Errorf("record %s = %+v, want it untouched", unq_id, record)
+		}
+	}
+	if r := f.sweep(); r.Consents != 0 {
+		t.Errorf("second sweep = %+v", r)
+	}
+}
+
+func TestSweepExpiredDeletesLapsedConsents(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.grant("3", "101")
+	f.grant("4", "101")
+	f.ok(f.custodian, "updateConsent", "2", "g", "all", s_date, "20170101", "101", "hippa")
+	f.ledger.Clock = func() time.Time { return time.Date(2016, 1, 2, 12, 0, 0, 0, time.UTC) }
+	r := f.sweep("delete", "2")
+	if r.Consents != 2 || r.Complete || r.Cursor == "" {
+		t.Fatalf("first sweep = %+v, want two consents and a cursor", r)
+	}
+	r = f.sweep("delete", "2", r.Cursor)
+	if r.Consents != 1 || !r.Complete {
+		t.Errorf("second sweep = %+v, want the last consent", r)
+	}
+	for _, p_id := range []string{"2", "3", "4"} {
+		if f.record(p_id) != nil || f.indexed(p_id) {
+			t.Errorf("patient %s still has its record or index entry", p_id)
+		}
+	}
+	if f.ledger.State()["2all"+s_date+"20170101hippa"] == nil {
+		t.Errorf("sweep deleted a consent that has not lapsed")
+	}
+	f.fails(errInvalidArgument, f.custodian, "sweepExpired", "delete", "2", "expiry_20150101_2")
+}
+
+func TestProposalDoesNotExtendActiveConsent(t *testing.T) {
+	f := newFixture(t)
+	f.grant("2", "101")
+	f.fails(errConflict, f.custodian, "updateConsent", "2", "p", "all", s_date, e_date, "101,102", "hippa")
+	if record := f.record("2"); len(record.ColumnIDs) != 1 || record.state() != stateActive {
+		t.Errorf("record after a refused proposal = %+v", record)
+	}
+	// a pending consent takes more columns, all granted together
+	f.ok(f.custodian, "updateConsent", "3", "p", "all", s_date, e_date, "101", "hippa")
+	f.ok(f.custodian, "updateConsent", "3", "p", "all", s_date, e_date, "102", "hippa")
+	if record := f.record("3"); len(record.ColumnIDs) != 2 || record.state() != statePending {
+		t.Errorf("pending record = %+v", record)
+	}
+	ops := []*consentOp{{PatientID: "4", Action: "g", RoleID: "all", StartDate: s_date, EndDate: e_date, ColumnIDs: []string{"101"}, WatchdogID: "hippa"},
+		{PatientID: "4", Action: "p", RoleID: "all", StartDate: s_date, EndDate: e_date, ColumnIDs: []string{"102"}, WatchdogID: "hippa"}}
+	opsAsBytes, _ := json.Marshal(ops)
+	report := &bulkReport{}
+	err := json.Unmarshal(f.ok(f.custodian, "bulkUpdateConsent", string(opsAsBytes), "per-item"), report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Results[0].Status != "applied" || report.Results[1].Code != errConflict {
+		t.Errorf("results = %+v", report.Results)
+	}
+	if record := f.record("4"); len(record.ColumnIDs) != 1 {
+		t.Errorf("columns after a refused proposal = %v", record.ColumnIDs)
+	}
+	f.fails(errInvalidArgument, f.custodian, "bulkUpdateConsent", string(opsAsBytes), "atomic")
+}